@@ -7,14 +7,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/daqnext/ECTSM-go/http/ectecho"
 	"github.com/daqnext/ECTSM-go/http/server"
 	"github.com/daqnext/ECTSM-go/utils"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 )
 
 var privateKeyBase64Str = "bhbb4EC96zx2uUsWDtSYivzaZUzdeDKMfn+dSV9VwUI="
-var publicKeyBase64Str = "BJJlxQFcPuVTjaB/PvbqmN0py98C2iScUQlvpRUm+kpAgqJmnofCely42Hczgb7cqwTZtFTfPwm2ImdmDtvFMH4="
 
 var hs *server.EctHttpServer
 
@@ -50,19 +49,20 @@ func StartHttpServer() {
 	e := echo.New()
 
 	//cors for html use
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		ExposeHeaders: []string{
-			"Ectm_key", "ectm_key",
-			"Ectm_time", "ectm_time",
-			"Ectm_token", "ectm_token",
-		},
-	}))
+	e.Use(ectecho.CORS())
 	// add middleware and routes
 	// ...
-	e.GET("/ectminfo", handlerEctminfo)
+	e.GET("/ectminfo", ectecho.PublicKeyInfoHandler(hs))
+	e.POST("/ectmhandshake", echo.WrapHandler(http.HandlerFunc(hs.ServeHandshake)))
+	e.POST("/ectmsession", echo.WrapHandler(http.HandlerFunc(hs.ServeSession)))
 	e.GET("/test/get", handlerGetTest)
 	e.POST("/test/post", handlerPostTest)
 
+	//routes behind the middleware get plain requests and send plain responses
+	g := e.Group("/mw", ectecho.Middleware(hs))
+	g.GET("/get", handlerMiddlewareGetTest)
+	g.POST("/post", handlerMiddlewarePostTest)
+
 	go func() {
 		if err := e.Start(":8080"); err != http.ErrServerClosed {
 			log.Fatal(err)
@@ -72,20 +72,12 @@ func StartHttpServer() {
 	time.Sleep(1 * time.Hour)
 }
 
-func handlerEctminfo(c echo.Context) error {
-
-	r := struct {
-		UnixTime  int64
-		PublicKey string
-	}{time.Now().Unix(), publicKeyBase64Str}
-	return c.JSON(200, &r)
-}
-
 func handlerGetTest(c echo.Context) error {
 	//check header
 	ectRq := hs.HandleGet(c.Request())
 	if ectRq.Err != nil {
-		return c.String(500, "decrypt header error")
+		statusCode, body := server.ECTSendBackError(c.Response().Header(), ectRq.Err)
+		return c.Blob(statusCode, "text/plain", body)
 	}
 
 	log.Println("symmetricKey", ectRq.GetSymmetricKey())
@@ -98,7 +90,7 @@ func handlerGetTest(c echo.Context) error {
 		Data   interface{}
 	}{0, "post success", nil}
 
-	sendData, err := server.ECTSendBack(c.Response().Header(), ectRq.SymmetricKey, data)
+	sendData, err := server.ECTSendBackTo(ectRq, c.Response().Header(), data)
 	if err != nil {
 		return c.String(500, err.Error())
 	}
@@ -109,7 +101,8 @@ func handlerPostTest(c echo.Context) error {
 
 	EctRq := hs.HandlePost(c.Request())
 	if EctRq.Err != nil {
-		return c.String(500, "decrypt post error:")
+		statusCode, body := server.ECTSendBackError(c.Response().Header(), EctRq.Err)
+		return c.Blob(statusCode, "text/plain", body)
 	}
 
 	//print result
@@ -130,9 +123,39 @@ func handlerPostTest(c echo.Context) error {
 		Data   interface{}
 	}{0, "post success", nil}
 
-	sendData, err := server.ECTSendBack(c.Response().Header(), EctRq.SymmetricKey, data)
+	sendData, err := server.ECTSendBackTo(EctRq, c.Response().Header(), data)
 	if err != nil {
 		return c.String(500, err.Error())
 	}
 	return c.Blob(200, "application/octet-stream", sendData)
 }
+
+func handlerMiddlewareGetTest(c echo.Context) error {
+	log.Println("token", string(ectecho.Token(c)))
+
+	data := struct {
+		Status int
+		Msg    string
+		Data   interface{}
+	}{0, "get success", nil}
+	return c.JSON(200, data)
+}
+
+func handlerMiddlewarePostTest(c echo.Context) error {
+	log.Println("token", string(ectecho.Token(c)))
+
+	var body struct {
+		Name string
+	}
+	if err := ectecho.Bind(c, &body); err != nil {
+		return ectecho.Error(c, 400, "bad_request", "body is not valid json", nil)
+	}
+	log.Println("Name:", body.Name)
+
+	data := struct {
+		Status int
+		Msg    string
+		Data   interface{}
+	}{0, "post success", nil}
+	return c.JSON(200, data)
+}
@@ -9,4 +9,6 @@ require (
 	github.com/ethereum/go-ethereum v1.10.8
 	github.com/imroc/req v0.3.0
 	github.com/labstack/echo/v4 v4.2.1
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/net v0.0.0-20210805182204-aaa1db679c0d
 )
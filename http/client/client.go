@@ -1,13 +1,15 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	ecthttp "github.com/daqnext/ECTSM-go/http"
@@ -20,113 +22,255 @@ type EctHttpClient struct {
 	SymmetricKey []byte
 	EcsKey       []byte
 	PublicKeyEc  *ecdsa.PublicKey
+	//utils.PublicKeyId of PublicKeyEc, tells the server which of its keys EcsKey is encrypted to
+	KeyId string
+	//set in handshake mode
+	HandshakeUrl string
+	//set in session mode
+	SessionUrl string
+	//sent instead of EcsKey once a handshake or session is established
+	SessionId string
+	//protocol version used for requests, the one of the server public key info unless set with WithProtocolVersion,
+	//ecthttp.ProtocolVersionCBC for old servers whose info has no version
+	ProtocolVersion int
+
+	symmetricKeyLen           int
+	timeout                   time.Duration
+	publicKeyTimeout          time.Duration
+	encryptQuery              bool
+	encryptHeaders            []string
+	streamThreshold           int
+	localPublicKey            string
+	pinnedPublicKey           string
+	pinnedIdentityFingerprint string
+	allowUnboundResponses     bool
+	httpTransport             http.RoundTripper
+
+	//guards SymmetricKey, EcsKey, PublicKeyEc, KeyId and SessionId, they change when the session is renewed
+	lock sync.RWMutex
+	//lets one renewal run at a time, it is not held while requests read the keys
+	renewLock sync.Mutex
+	//increased on every renewal, so concurrent requests renew only once
+	generation uint64
+	//fingerprint of the identity key trusted since the first public key fetch, if none is pinned
+	identityFingerprint string
+}
+
+//keyState is a snapshot of the keys used by one request
+type keyState struct {
+	symmetricKey []byte
+	ecsKey       []byte
+	keyId        string
+	sessionId    string
+	generation   uint64
 }
 
 const DefaultTimeout = 30
+const DefaultPublicKeyTimeout = 15
+
+//Timeout limits one request, pass it in v of ECTGet or ECTPost
+type Timeout time.Duration
+
+//StreamResponse in v of ECTGet or ECTPost leaves the response body unread, ECTResponse.BodyReader decrypts it while read
+//so a large response is never held in memory, an error envelope is still read at once
+//the client timeout and a Timeout keep limiting the request until BodyReader is closed
+type StreamResponse struct{}
 
-func New(publicKeyUrl string) (*EctHttpClient, error) {
-	rand.Seed(time.Now().UnixNano())
+//New fetches the public key info from publicKeyUrl and sets up the key
+//without WithPublicKey, WithPinnedPublicKey or WithIdentityFingerprint the client trusts on first use:
+//it accepts the identity key of the first signed info it fetches, so whoever answers that fetch,
+//e.g. a man in the middle without TLS, gets the traffic, later fetches must be signed by the same identity key
+func New(publicKeyUrl string, opts ...Option) (*EctHttpClient, error) {
+	return NewWithContext(context.Background(), publicKeyUrl, opts...)
+}
+
+//NewWithContext is New, ctx aborts fetching the public key and setting up the key
+func NewWithContext(ctx context.Context, publicKeyUrl string, opts ...Option) (*EctHttpClient, error) {
 	hc := &EctHttpClient{
 		PublicKeyUrl: publicKeyUrl,
 	}
+	defaultOptions(hc)
+	for _, opt := range opts {
+		opt(hc)
+	}
+	if !utils.IsValidSymmetricKeyLength(hc.symmetricKeyLen) {
+		return nil, ecthttp.ErrInvalidKeyLength
+	}
 
-	r := req.New()
-	r.SetTimeout(time.Second * 15)
-	response, err := r.Do("GET", publicKeyUrl)
+	serverKey, err := hc.fetchServerKey(ctx, "")
 	if err != nil {
 		return nil, err
 	}
-	type publicKeyResponse struct {
-		UnixTime  int64
-		PublicKey string
+	if hc.ProtocolVersion == 0 {
+		hc.ProtocolVersion = serverKey.protocolVersion
 	}
-	var responseData publicKeyResponse
-	err = response.ToJSON(&responseData)
+	state, err := hc.newKeyState(ctx, serverKey)
 	if err != nil {
 		return nil, err
 	}
+	hc.setKeys(serverKey, state)
+	return hc, nil
+}
 
-	//time
-	nowTime := time.Now().Unix()
-	timeGap := nowTime - responseData.UnixTime
-	if timeGap < -ecthttp.AllowServerClientTimeGap || timeGap > ecthttp.AllowServerClientTimeGap {
-		return nil, errors.New("time error")
-	}
-	//pubKey
-	pubKey, err := utils.StrBase64ToPublicKey(responseData.PublicKey)
+//serverKey is the server public key the client encrypts to
+type serverKey struct {
+	publicKey *ecdsa.PublicKey
+	keyId     string
+	//fingerprint of the identity key that signed the public key info, "" if not signed
+	identityFingerprint string
+	//the newest protocol version both sides support
+	protocolVersion int
+}
+
+//fetchServerKey gets the server public key, trustedFingerprint is the identity fingerprint trusted so far
+func (hc *EctHttpClient) fetchServerKey(ctx context.Context, trustedFingerprint string) (*serverKey, error) {
+	serverKey, err := hc.getPublicKey(ctx, trustedFingerprint)
 	if err != nil {
 		return nil, err
 	}
-	hc.PublicKeyEc = pubKey
+	if serverKey.identityFingerprint == "" {
+		serverKey.identityFingerprint = trustedFingerprint
+	}
+	return serverKey, nil
+}
+
+//newKeyState sets up a new symmetric key for serverKey, by handshake or by ecs key with an optional session
+//it does not change hc, see setKeys
+func (hc *EctHttpClient) newKeyState(ctx context.Context, serverKey *serverKey) (*keyState, error) {
+	if hc.HandshakeUrl != "" {
+		return hc.handshake(ctx, serverKey)
+	}
 
 	//randKey
-	hc.SymmetricKey = utils.GenSymmetricKey()
-	hc.EcsKey, err = utils.ECCEncrypt(hc.PublicKeyEc, hc.SymmetricKey)
+	symmetricKey, err := utils.GenSymmetricKeyWithLength(hc.symmetricKeyLen)
 	if err != nil {
 		return nil, err
 	}
-	return hc, nil
-}
-
-func (hc *EctHttpClient) ECTGet(url string, Token []byte, v ...interface{}) *ecthttp.ECTResponse {
-	//header
-	header := make(http.Header)
-	err := ecthttp.EncryptAndSetECTMHeader(header, hc.EcsKey, hc.SymmetricKey, Token)
+	ecsKey, err := utils.ECCEncrypt(serverKey.publicKey, symmetricKey)
 	if err != nil {
-		return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
+		return nil, err
 	}
+	state := &keyState{symmetricKey: symmetricKey, ecsKey: ecsKey, keyId: serverKey.keyId}
 
-	r := req.New()
-	r.SetTimeout(time.Duration(DefaultTimeout) * time.Second)
-
-	rs, err := r.Get(url, header, v)
-	if err != nil {
-		return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
+	if hc.SessionUrl != "" {
+		state.sessionId, err = hc.newSession(ctx, state)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return state, nil
+}
 
-	body, err := ioutil.ReadAll(rs.Response().Body)
-	if err != nil {
-		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: errors.New("body error")}
+//setKeys makes the client use serverKey and state, it must be called with hc.lock held, or before hc is shared
+func (hc *EctHttpClient) setKeys(serverKey *serverKey, state *keyState) {
+	hc.PublicKeyEc, hc.KeyId, hc.identityFingerprint = serverKey.publicKey, serverKey.keyId, serverKey.identityFingerprint
+	hc.SymmetricKey, hc.EcsKey, hc.SessionId = state.symmetricKey, state.ecsKey, state.sessionId
+}
+
+//ErrSessionResponse means the answer of SessionUrl has no session id
+var ErrSessionResponse = errors.New("session response error")
+
+//newSession sends the ecs key of state once to SessionUrl and returns the session id
+func (hc *EctHttpClient) newSession(ctx context.Context, state *keyState) (string, error) {
+	result := hc.send(ctx, "POST", hc.SessionUrl, nil, &requestBody{}, state, nil)
+	if result.Err != nil {
+		return "", result.Err
 	}
+	var sessionResponse ecthttp.SessionResponse
+	err := json.Unmarshal(result.DecryptedBody, &sessionResponse)
+	if err != nil || sessionResponse.SessionId == "" {
+		return "", ErrSessionResponse
+	}
+	return sessionResponse.SessionId, nil
+}
 
-	if rs.Response().StatusCode != 200 {
-		errStr := fmt.Sprintf("response status error,status code:%d,content:%s", rs.Response().StatusCode, string(body))
-		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: errors.New(errStr)}
+func (hc *EctHttpClient) getKeyState() *keyState {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	return &keyState{
+		symmetricKey: hc.SymmetricKey,
+		ecsKey:       hc.EcsKey,
+		keyId:        hc.KeyId,
+		sessionId:    hc.SessionId,
+		generation:   hc.generation,
 	}
+}
 
-	_, err = ecthttp.DecryptECTMHeader(rs.Response().Header, hc.SymmetricKey)
-	if err != nil {
-		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: err}
+//renewKey sets up a new key unless another request already did since generation
+//refreshPublicKey re-fetches the server public key first, for when the server rotated its key
+//the new key is set up without holding hc.lock, so requests keep going meanwhile
+func (hc *EctHttpClient) renewKey(ctx context.Context, generation uint64, refreshPublicKey bool) error {
+	hc.renewLock.Lock()
+	defer hc.renewLock.Unlock()
+
+	hc.lock.RLock()
+	current := hc.generation
+	serverKey := &serverKey{publicKey: hc.PublicKeyEc, keyId: hc.KeyId, identityFingerprint: hc.identityFingerprint}
+	hc.lock.RUnlock()
+	if current != generation {
+		return nil
 	}
 
-	//decrypt response body
-	decryptBody, err := ecthttp.DecryptBody(body, hc.SymmetricKey)
+	var err error
+	if refreshPublicKey {
+		serverKey, err = hc.fetchServerKey(ctx, serverKey.identityFingerprint)
+		if err != nil {
+			return err
+		}
+	}
+	state, err := hc.newKeyState(ctx, serverKey)
+	//a handshake or session request found the key rotated
+	if errors.Is(err, ecthttp.ErrUnknownKey) && !refreshPublicKey {
+		serverKey, err = hc.fetchServerKey(ctx, serverKey.identityFingerprint)
+		if err != nil {
+			return err
+		}
+		state, err = hc.newKeyState(ctx, serverKey)
+	}
 	if err != nil {
-		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: errors.New("body decrypt error")}
+		return err
 	}
 
-	return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: decryptBody, Err: nil}
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	hc.setKeys(serverKey, state)
+	hc.generation++
+	return nil
+}
+
+func (hc *EctHttpClient) ECTGet(url string, Token []byte, v ...interface{}) *ecthttp.ECTResponse {
+	return hc.ECTDoCtx(context.Background(), "GET", url, Token, nil, v...)
+}
+
+//ECTGetCtx is ECTGet, ctx aborts the request and a key renewal it causes
+func (hc *EctHttpClient) ECTGetCtx(ctx context.Context, url string, Token []byte, v ...interface{}) *ecthttp.ECTResponse {
+	return hc.ECTDoCtx(ctx, "GET", url, Token, nil, v...)
 }
 
 func (hc *EctHttpClient) ECTPost(url string, Token []byte, data interface{}, v ...interface{}) *ecthttp.ECTResponse {
+	return hc.ECTDoCtx(context.Background(), "POST", url, Token, data, v...)
+}
 
-	//header
-	header := make(http.Header)
-	err := ecthttp.EncryptAndSetECTMHeader(header, hc.EcsKey, hc.SymmetricKey, Token)
-	if err != nil {
-		return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
-	}
+//ECTPostCtx is ECTPost, ctx aborts the request and a key renewal it causes
+func (hc *EctHttpClient) ECTPostCtx(ctx context.Context, url string, Token []byte, data interface{}, v ...interface{}) *ecthttp.ECTResponse {
+	return hc.ECTDoCtx(ctx, "POST", url, Token, data, v...)
+}
 
-	//set request timeout
-	r := req.New()
-	r.SetTimeout(time.Duration(DefaultTimeout) * time.Second)
+//ECTDo sends a request of any method, data is a string, []byte, io.Reader or a value sent as json, nil for no body
+//an io.Reader, and data larger than the stream threshold, is streamed in encrypted chunks
+//v is passed to req like in ECTGet and ECTPost
+func (hc *EctHttpClient) ECTDo(method string, url string, Token []byte, data interface{}, v ...interface{}) *ecthttp.ECTResponse {
+	return hc.ECTDoCtx(context.Background(), method, url, Token, data, v...)
+}
 
-	var EncryptedBody []byte
+//ECTDoCtx is ECTDo, ctx aborts the request and a key renewal it causes
+func (hc *EctHttpClient) ECTDoCtx(ctx context.Context, method string, url string, Token []byte, data interface{}, v ...interface{}) *ecthttp.ECTResponse {
 	var toEncrypt []byte
+	var stream io.Reader
+	var err error
 
 	if data == nil {
 		toEncrypt = nil
-		EncryptedBody = nil
 	} else {
 
 		switch data.(type) {
@@ -134,45 +278,321 @@ func (hc *EctHttpClient) ECTPost(url string, Token []byte, data interface{}, v .
 			toEncrypt = []byte(data.(string))
 		case []byte:
 			toEncrypt = data.([]byte)
+		case io.Reader:
+			if hc.streamsBody(-1) {
+				stream = data.(io.Reader)
+				break
+			}
+			toEncrypt, err = ioutil.ReadAll(data.(io.Reader))
+			if err != nil {
+				return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
+			}
 		default:
 			toEncrypt, err = json.Marshal(data)
 			if err != nil {
 				return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
 			}
 		}
-		EncryptedBody, err = ecthttp.EncryptBody(toEncrypt, hc.SymmetricKey)
+	}
+	if toEncrypt != nil && hc.streamsBody(int64(len(toEncrypt))) {
+		stream, toEncrypt = bytes.NewReader(toEncrypt), nil
+	}
+
+	return hc.request(ctx, method, url, Token, &requestBody{data: toEncrypt, stream: stream}, v)
+}
+
+//requestBody is the body of one request, data and stream are nil for requests without body
+type requestBody struct {
+	data []byte
+	//sent in encrypted chunks instead of data
+	stream io.Reader
+	//sent in the encrypted ectm_headers header, the plain content type only tells the body is encrypted
+	contentType string
+}
+
+//streamsBody tells if a body of size bytes, -1 if unknown, is streamed
+func (hc *EctHttpClient) streamsBody(size int64) bool {
+	if hc.ProtocolVersion == ecthttp.ProtocolVersionCBC || hc.streamThreshold <= 0 {
+		return false
+	}
+	return size < 0 || size > int64(hc.streamThreshold)
+}
+
+//request sends with the current keys, and once more with new keys
+//if the server lost the session or no longer has the private key the client encrypted to
+//a stream is only sent again if it is an io.Seeker
+func (hc *EctHttpClient) request(ctx context.Context, method string, url string, Token []byte, body *requestBody, v []interface{}) *ecthttp.ECTResponse {
+	var rewind func() error
+	if seeker, ok := body.stream.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			rewind = func() error {
+				_, err := seeker.Seek(start, io.SeekStart)
+				return err
+			}
+		}
+	}
+
+	state := hc.getKeyState()
+	result := hc.send(ctx, method, url, Token, body, state, v)
+
+	retry, err := hc.renewOn(ctx, result.Err, state)
+	if err != nil {
+		return &ecthttp.ECTResponse{Rs: result.Rs, DecryptedBody: nil, Err: err}
+	}
+	if !retry {
+		return result
+	}
+	if body.stream != nil && (rewind == nil || rewind() != nil) {
+		return result
+	}
+	return hc.send(ctx, method, url, Token, body, hc.getKeyState(), v)
+}
+
+//renewOn renews the keys of state if err says the server lost the session or no longer has
+//the private key the client encrypted to, and tells if the request should be sent again
+func (hc *EctHttpClient) renewOn(ctx context.Context, err error, state *keyState) (bool, error) {
+	switch {
+	case errors.Is(err, ecthttp.ErrUnknownKey):
+		//the server rotated its key
+		return true, hc.renewKey(ctx, state.generation, true)
+	case errors.Is(err, ecthttp.ErrUnknownSession) && state.sessionId != "":
+		//the session expired or was revoked
+		return true, hc.renewKey(ctx, state.generation, false)
+	default:
+		return false, nil
+	}
+}
+
+//roundTripper returns the transport set with WithHTTPTransport, http.DefaultTransport if not set
+func (hc *EctHttpClient) roundTripper() http.RoundTripper {
+	if hc.httpTransport == nil {
+		return http.DefaultTransport
+	}
+	return hc.httpTransport
+}
+
+//newReq returns a req for one request, sent with the transport of the client and limited by timeout
+func (hc *EctHttpClient) newReq(timeout time.Duration) *req.Req {
+	r := req.New()
+	if hc.httpTransport != nil {
+		r.SetClient(&http.Client{Transport: hc.httpTransport})
+	}
+	r.SetTimeout(timeout)
+	return r
+}
+
+//setKeyHeader sets ectm_session or ectm_kid and returns the ecs key to send, nil in session mode
+func setKeyHeader(header http.Header, state *keyState) []byte {
+	if state.sessionId != "" {
+		header.Set("ectm_session", state.sessionId)
+		return nil
+	}
+	if state.keyId != "" {
+		header.Set("ectm_kid", state.keyId)
+	}
+	return state.ecsKey
+}
+
+//responseError returns the error for a response the server did not encrypt
+func responseError(rs *http.Response, body []byte) error {
+	return &ecthttp.StatusError{StatusCode: rs.StatusCode, Code: ecthttp.GetErrorCode(rs.Header), Body: body}
+}
+
+//send encrypts and sends one request
+func (hc *EctHttpClient) send(ctx context.Context, method string, url string, Token []byte, body *requestBody, state *keyState, v []interface{}) *ecthttp.ECTResponse {
+	ctx, v, cancel := withRequestTimeout(ctx, v)
+	streamResponse, v := withStreamResponse(v)
+	//a streamed response body releases ctx when it is closed
+	bodyStreamed := false
+	defer func() {
+		if !bodyStreamed {
+			cancel()
+		}
+	}()
+
+	//header
+	header := make(http.Header)
+	ecsKey := setKeyHeader(header, state)
+	ectmHeader := &ecthttp.ECTMHeader{Version: hc.ProtocolVersion, Token: Token}
+	err := ecthttp.SetECTMHeader(header, ecsKey, state.symmetricKey, ectmHeader)
+	if err != nil {
+		return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
+	}
+	if hc.ProtocolVersion != ecthttp.ProtocolVersionCBC {
+		ecthttp.SetAcceptStream(header)
+	}
+
+	//set request timeout
+	r := hc.newReq(hc.timeout)
+	st := signWith(r, hc, state.symmetricKey, ectmHeader)
+
+	vs := []interface{}{header, ctx}
+	st.contentType = body.contentType
+	if body.stream != nil {
+		streamId, err := ecthttp.NewStreamId()
 		if err != nil {
 			return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
 		}
+		encryptReader, err := ecthttp.NewEncryptReader(body.stream, state.symmetricKey, streamId, nil)
+		if err != nil {
+			return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
+		}
+		ecthttp.SetStreamHeader(header, streamId)
+		st.streamId = streamId
+		vs = append(vs, encryptReader, req.Header{
+			"Content-Type": "application/octet-stream",
+		})
+	} else if body.data != nil {
+		EncryptedBody, err := ecthttp.EncryptBodyWithVersion(body.data, state.symmetricKey, hc.ProtocolVersion)
+		if err != nil {
+			return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
+		}
+		vs = append(vs, EncryptedBody, req.Header{
+			"Content-Type": "text/plain",
+		})
 	}
 
-	rs, err := r.Post(url, header, EncryptedBody, req.Header{
-		"Content-Type": "text/plain",
-	}, v)
+	rs, err := r.Do(method, url, append(vs, v...)...)
 	if err != nil {
 		return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
 	}
 
-	body, err := ioutil.ReadAll(rs.Response().Body)
+	streamId, err := ecthttp.GetStreamId(rs.Response().Header)
 	if err != nil {
-		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: errors.New("body error")}
+		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: err}
 	}
 
-	if rs.Response().StatusCode != 200 {
-		errStr := fmt.Sprintf("response status error,status code:%d,content:%s", rs.Response().StatusCode, string(body))
-		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: errors.New(errStr)}
+	//an error envelope is encrypted like a success response, the marker is bound to its body
+	isEnvelope := ecthttp.GetErrorCode(rs.Response().Header) == ecthttp.ErrorCodeEnvelope
+	if (rs.Response().StatusCode < 200 || rs.Response().StatusCode > 299) && !isEnvelope {
+		body, err := ioutil.ReadAll(rs.Response().Body)
+		if err != nil {
+			return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: ecthttp.ErrBody}
+		}
+		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: responseError(rs.Response(), body)}
 	}
 
-	_, err = ecthttp.DecryptECTMHeader(rs.Response().Header, hc.SymmetricKey)
+	responseHeader, err := hc.checkResponseHeader(rs.Response().Header, state.symmetricKey, ectmHeader, st.sig)
+	if err != nil {
+		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: err}
+	}
+	err = ecthttp.RestoreEncryptedHeaders(rs.Response().Header, state.symmetricKey, responseHeader)
 	if err != nil {
 		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: err}
 	}
 
 	//decrypt response body
-	decryptBody, err := ecthttp.DecryptBody(body, hc.SymmetricKey)
+	if streamResponse && !responseHeader.Envelope {
+		bodyReader, err := hc.responseBodyReader(rs.Response().Body, state.symmetricKey, responseHeader, streamId)
+		if err != nil {
+			return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: err}
+		}
+		bodyStreamed = true
+		closer := &bodyCloser{body: rs.Response().Body, cancel: cancel}
+		return &ecthttp.ECTResponse{Rs: rs.Response(), BodyReader: readCloser{Reader: bodyReader, Closer: closer}, Err: nil}
+	}
+	decryptBody, err := hc.readResponseBody(rs.Response().Body, state.symmetricKey, responseHeader, streamId)
 	if err != nil {
-		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: errors.New("decrypt error")}
+		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: nil, Err: err}
 	}
 
+	if responseHeader.Envelope {
+		return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: decryptBody, Err: ecthttp.ParseRemoteError(rs.Response().StatusCode, decryptBody)}
+	}
 	return &ecthttp.ECTResponse{Rs: rs.Response(), DecryptedBody: decryptBody, Err: nil}
 }
+
+//readResponseBody reads and decrypts a response body, streamId is nil if it is not streamed
+func (hc *EctHttpClient) readResponseBody(body io.Reader, symmetricKey []byte, responseHeader *ecthttp.ECTMHeader, streamId []byte) ([]byte, error) {
+	bodyReader, err := hc.responseBodyReader(body, symmetricKey, responseHeader, streamId)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(bodyReader)
+}
+
+//responseBodyReader returns a reader of the decrypted response body, streamId is nil if it is not streamed
+//the chunks of a streamed response are bound to the request like the response header and decrypted while read,
+//a body that is not streamed is one ciphertext and decrypted at once
+func (hc *EctHttpClient) responseBodyReader(body io.Reader, symmetricKey []byte, responseHeader *ecthttp.ECTMHeader, streamId []byte) (io.Reader, error) {
+	if streamId != nil {
+		return ecthttp.NewDecryptReader(body, symmetricKey, streamId, ecthttp.ResponseAdditionalData(responseHeader))
+	}
+
+	encryptedBody, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, ecthttp.ErrBody
+	}
+	decryptBody, err := ecthttp.DecryptResponseBody(encryptedBody, symmetricKey, responseHeader)
+	if err != nil {
+		return nil, &ecthttp.DecryptError{Stage: ecthttp.DecryptStageBody, Err: err}
+	}
+	return bytes.NewReader(decryptBody), nil
+}
+
+//bodyCloser closes a streamed response body and releases the context of its request
+type bodyCloser struct {
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (bc *bodyCloser) Close() error {
+	err := bc.body.Close()
+	bc.cancel()
+	return err
+}
+
+//withStreamResponse tells if v has a StreamResponse and removes it from v, which is passed on to req
+func withStreamResponse(v []interface{}) (bool, []interface{}) {
+	streamResponse := false
+	rest := make([]interface{}, 0, len(v))
+	for _, value := range v {
+		if _, ok := value.(StreamResponse); ok {
+			streamResponse = true
+			continue
+		}
+		rest = append(rest, value)
+	}
+	return streamResponse, rest
+}
+
+//withRequestTimeout applies a Timeout in v to ctx and removes it from v, which is passed on to req
+func withRequestTimeout(ctx context.Context, v []interface{}) (context.Context, []interface{}, context.CancelFunc) {
+	var timeout Timeout
+	rest := make([]interface{}, 0, len(v))
+	for _, value := range v {
+		if t, ok := value.(Timeout); ok {
+			timeout = t
+			continue
+		}
+		rest = append(rest, value)
+	}
+	if timeout <= 0 {
+		return ctx, rest, func() {}
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout))
+	return ctx, rest, cancel
+}
+
+//checkResponseHeader decrypts the response header and makes sure the server answered
+//in the version we asked for, so a stripped version header can not downgrade the response,
+//and that the response echoes the digest of our request
+func (hc *EctHttpClient) checkResponseHeader(header http.Header, symmetricKey []byte, requestHeader *ecthttp.ECTMHeader, sig []byte) (*ecthttp.ECTMHeader, error) {
+	ectmHeader, err := ecthttp.ParseECTMHeader(header, symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	if ectmHeader.Version != hc.ProtocolVersion {
+		return nil, ecthttp.ErrVersionMismatch
+	}
+	//legacy servers do not bind responses, neither does the deprecated server.ECTSendBack
+	if ectmHeader.Version == ecthttp.ProtocolVersionCBC || (len(ectmHeader.Bind) == 0 && hc.allowUnboundResponses) {
+		return ectmHeader, nil
+	}
+	err = ecthttp.VerifyResponseBinding(ectmHeader, requestHeader.Nonce, sig)
+	if err != nil {
+		return nil, err
+	}
+	return ectmHeader, nil
+}
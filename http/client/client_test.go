@@ -0,0 +1,498 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/http/server"
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//testServer serves the ECTSM endpoints, /echo, which answers "token:body", and /events, which sends one event "token"
+type testServer struct {
+	*httptest.Server
+	hs *server.EctHttpServer
+	//number of public key info fetches
+	infoFetches int32
+	//called before the public key info is served, if set
+	beforeInfo func()
+}
+
+func newTestServer(t *testing.T, opts ...server.Option) *testServer {
+	privateKey, _, err := utils.GenAndPrintEccKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := server.New(privateKey, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{hs: hs}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ectminfo", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ts.infoFetches, 1)
+		if ts.beforeInfo != nil {
+			ts.beforeInfo()
+		}
+		hs.ServePublicKeyInfo(w, r)
+	})
+	mux.HandleFunc("/handshake", hs.ServeHandshake)
+	mux.HandleFunc("/session", hs.ServeSession)
+	mux.Handle("/echo", hs.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		//-1 for a streamed body
+		w.Header().Set("X-Request-Length", strconv.FormatInt(r.ContentLength, 10))
+		w.Header().Set("X-Request-Query", r.URL.RawQuery)
+		w.Write([]byte(string(server.TokenFromContext(r.Context())) + ":" + string(body)))
+	})))
+	mux.Handle("/events", hs.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw, err := server.NewSSEWriter(w, server.RequestFromContext(r.Context()))
+		if err != nil {
+			return
+		}
+		sw.Send("", server.TokenFromContext(r.Context()))
+		//keep the stream open until the client closes it
+		<-r.Context().Done()
+	})))
+	//answers after 5 seconds, or when the client gives up
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		//the closed connection is only noticed once the body is read
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	ts.Server = httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *testServer) rotateKey(t *testing.T) {
+	privateKey, _, err := utils.GenAndPrintEccKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the previous key is retired at once
+	err = ts.hs.RotateKey(privateKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_RenewOnKeyRotation(t *testing.T) {
+	for _, mode := range []string{"ecs", "session", "handshake"} {
+		ts := newTestServer(t)
+		var opts []Option
+		switch mode {
+		case "session":
+			opts = append(opts, WithSession(ts.URL+"/session"))
+		case "handshake":
+			opts = append(opts, WithHandshake(ts.URL+"/handshake"))
+		}
+		hc, err := New(ts.URL+"/ectminfo", opts...)
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		result := hc.ECTPost(ts.URL+"/echo", []byte("token"), "before")
+		if result.Err != nil || result.ToString() != "token:before" {
+			t.Fatal(mode, result.Err, result.ToString())
+		}
+
+		ts.rotateKey(t)
+		if hc.SessionId != "" {
+			//sessions outlive a rotation, the new session is set up with the new key
+			ts.hs.RevokeSession(hc.SessionId)
+		}
+		//concurrent requests all fail with the old key, only one of them renews
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result := hc.ECTPost(ts.URL+"/echo", []byte("token"), "after")
+				if result.Err != nil || result.ToString() != "token:after" {
+					t.Error(mode, result.Err, result.ToString())
+				}
+			}()
+		}
+		wg.Wait()
+		if fetches := atomic.LoadInt32(&ts.infoFetches); fetches != 2 {
+			t.Fatal(mode, "public key info fetched", fetches, "times")
+		}
+		if hc.KeyId != ts.hs.Keyring.Current().KeyId {
+			t.Fatal(mode, "client did not switch to the new key")
+		}
+	}
+}
+
+func Test_RenewDoesNotBlockRequests(t *testing.T) {
+	ts := newTestServer(t)
+	hc, err := New(ts.URL + "/ectminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//hold the public key fetch of the renewal
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ts.beforeInfo = func() {
+		close(entered)
+		<-release
+	}
+	renewed := make(chan error)
+	go func() {
+		renewed <- hc.renewKey(context.Background(), hc.getKeyState().generation, true)
+	}()
+	<-entered
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result := hc.ECTGet(ts.URL+"/echo", []byte("token"))
+		if result.Err != nil || result.ToString() != "token:" {
+			t.Error(result.Err, result.ToString())
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("request blocked by the renewal")
+	}
+
+	close(release)
+	if err := <-renewed; err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func Test_RequestCancel(t *testing.T) {
+	ts := newTestServer(t)
+	hc, err := New(ts.URL+"/ectminfo", WithTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//ctx cancelled while waiting for the response
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	result := hc.ECTGetCtx(ctx, ts.URL+"/slow", nil)
+	if !errors.Is(result.Err, context.Canceled) || time.Since(start) > time.Second {
+		t.Fatal("request not cancelled:", result.Err, time.Since(start))
+	}
+
+	//Timeout limits one request
+	start = time.Now()
+	result = hc.ECTPost(ts.URL+"/slow", nil, "body", Timeout(50*time.Millisecond))
+	if !errors.Is(result.Err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatal("request not timed out:", result.Err, time.Since(start))
+	}
+
+	//WithTimeout limits every request
+	start = time.Now()
+	result = hc.ECTGet(ts.URL+"/slow", nil)
+	var netError net.Error
+	if !errors.As(result.Err, &netError) || !netError.Timeout() || time.Since(start) > time.Second {
+		t.Fatal("request not timed out:", result.Err, time.Since(start))
+	}
+}
+
+func Test_NewWithContext(t *testing.T) {
+	ts := newTestServer(t)
+	release := make(chan struct{})
+	defer close(release)
+	ts.beforeInfo = func() {
+		<-release
+	}
+
+	//ctx cancelled while fetching the public key info
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := NewWithContext(ctx, ts.URL+"/ectminfo")
+	if !errors.Is(err, context.Canceled) || time.Since(start) > time.Second {
+		t.Fatal("key info fetch not cancelled:", err, time.Since(start))
+	}
+
+	//ctx cancelled during the handshake
+	info, err := ts.hs.PublicKeyInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = NewWithContext(ctx, "", WithPublicKey(info.PublicKey), WithHandshake(ts.URL+"/slow"))
+	if !errors.Is(err, context.Canceled) || time.Since(start) > time.Second {
+		t.Fatal("handshake not cancelled:", err, time.Since(start))
+	}
+}
+
+func Test_StreamResponse(t *testing.T) {
+	ts := newTestServer(t, server.WithStreamThreshold(1000))
+	hc, err := New(ts.URL + "/ectminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("0123456789abcdef", 4096)
+	for _, data := range []string{"small", large} {
+		//the Timeout must not end the request before the body is read
+		result := hc.ECTPost(ts.URL+"/echo", []byte("token"), data, StreamResponse{}, Timeout(5*time.Second))
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		if result.DecryptedBody != nil || result.BodyReader == nil {
+			t.Fatal("response body not streamed")
+		}
+		if streamId, _ := ecthttp.GetStreamId(result.Rs.Header); (streamId != nil) != (data == large) {
+			t.Fatal("server stream error")
+		}
+		body, err := ioutil.ReadAll(result.BodyReader)
+		result.BodyReader.Close()
+		if err != nil || string(body) != "token:"+data {
+			t.Fatal(err, len(body))
+		}
+	}
+}
+
+//countingTransport counts the requests sent with http.DefaultTransport
+type countingTransport struct {
+	requests int32
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.requests, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func Test_HTTPTransport(t *testing.T) {
+	ts := newTestServer(t)
+	transport := &countingTransport{}
+	hc, err := New(ts.URL+"/ectminfo", WithHandshake(ts.URL+"/handshake"), WithHTTPTransport(transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//public key info and handshake
+	if requests := atomic.LoadInt32(&transport.requests); requests != 2 {
+		t.Fatal("key setup requests:", requests)
+	}
+
+	result := hc.ECTPost(ts.URL+"/echo", []byte("token"), "body")
+	if result.Err != nil || result.ToString() != "token:body" {
+		t.Fatal(result.Err, result.ToString())
+	}
+	rs, err := (&http.Client{Transport: hc.Transport()}).Get(ts.URL + "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	es, err := hc.Subscribe(context.Background(), ts.URL+"/events", []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := <-es.Events
+	es.Close()
+	if event == nil || event.ToString() != "token" {
+		t.Fatal("event error:", es.Err())
+	}
+	if requests := atomic.LoadInt32(&transport.requests); requests != 5 {
+		t.Fatal("requests:", requests)
+	}
+}
+
+//captureTransport keeps the last request sent with http.DefaultTransport, so a test can replay it
+type captureTransport struct {
+	lock    sync.Mutex
+	request *http.Request
+	body    []byte
+}
+
+func (ct *captureTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ct.lock.Lock()
+	ct.request, ct.body = r.Clone(context.Background()), body
+	ct.lock.Unlock()
+	sent := r.Clone(r.Context())
+	sent.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return http.DefaultTransport.RoundTrip(sent)
+}
+
+//replay sends the captured request again and returns the status code and body
+func (ct *captureTransport) replay(t *testing.T) (int, string) {
+	ct.lock.Lock()
+	replayed := ct.request.Clone(context.Background())
+	replayed.Body = ioutil.NopCloser(bytes.NewReader(ct.body))
+	ct.lock.Unlock()
+	rs, err := http.DefaultTransport.RoundTrip(replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+	body, _ := ioutil.ReadAll(rs.Body)
+	return rs.StatusCode, string(body)
+}
+
+//shortNonceStore forgets nonces after a second, so a test sees them expire
+type shortNonceStore struct {
+	*server.MemNonceStore
+}
+
+func (ns shortNonceStore) Add(key string, ttlSec int64) error {
+	return ns.MemNonceStore.Add(key, 1)
+}
+
+func Test_ReplayProtection(t *testing.T) {
+	ts := newTestServer(t, server.WithReplayProtection(100))
+	transport := &captureTransport{}
+	hc, err := New(ts.URL+"/ectminfo", WithHTTPTransport(transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := hc.ECTPost(ts.URL+"/echo", []byte("token"), "body")
+	if result.Err != nil || result.ToString() != "token:body" {
+		t.Fatal(result.Err, result.ToString())
+	}
+	statusCode, body := transport.replay(t)
+	if statusCode != http.StatusBadRequest || body != server.ErrReplayedRequest.Error() {
+		t.Fatal("replayed request accepted:", statusCode, body)
+	}
+
+	//once the nonce is forgotten the time window rejects the replay
+	ts = newTestServer(t, server.WithNonceStore(shortNonceStore{server.NewMemNonceStore(100)}))
+	hc, err = New(ts.URL + "/ectminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a request at the edge of the time window
+	ectmHeader := &ecthttp.ECTMHeader{Version: ecthttp.ProtocolVersionGCM, UnixTime: time.Now().Unix() - ecthttp.AllowRequestTimeGapSec + 1}
+	encrypted, err := ecthttp.EncryptBodyWithVersion([]byte("body"), hc.SymmetricKey, ecthttp.ProtocolVersionGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest("POST", ts.URL+"/echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ecthttp.SetECTMHeader(r.Header, hc.EcsKey, hc.SymmetricKey, ectmHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ecthttp.SetRequestSignature(r.Header, hc.SymmetricKey, r.Method, r.URL, ectmHeader, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.request, transport.body = r, encrypted
+	statusCode, body = transport.replay(t)
+	if statusCode != http.StatusOK {
+		t.Fatal(statusCode, body)
+	}
+	time.Sleep(2 * time.Second)
+	statusCode, body = transport.replay(t)
+	if statusCode != http.StatusBadRequest || !strings.Contains(body, "time Gap") {
+		t.Fatal("replayed request accepted after the nonce expired:", statusCode, body)
+	}
+}
+
+func Test_EncryptedQuery(t *testing.T) {
+	ts := newTestServer(t)
+	transport := &captureTransport{}
+	hc, err := New(ts.URL+"/ectminfo", WithEncryptedQuery(), WithHTTPTransport(transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := hc.ECTGet(ts.URL+"/echo?user=alice&id=7", []byte("token"))
+	if result.Err != nil || result.ToString() != "token:" {
+		t.Fatal(result.Err, result.ToString())
+	}
+	if query := result.Rs.Header.Get("X-Request-Query"); query != "user=alice&id=7" {
+		t.Fatal("query not restored:", query)
+	}
+	if transport.request.URL.RawQuery != "" || transport.request.Header.Get("ectm_query") == "" {
+		t.Fatal("query sent plain:", transport.request.URL.RawQuery)
+	}
+
+	//Transport encrypts the query too
+	rs, err := (&http.Client{Transport: hc.Transport()}).Get(ts.URL + "/echo?user=bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	if rs.Header.Get("X-Request-Query") != "user=bob" || transport.request.URL.RawQuery != "" {
+		t.Fatal("query error:", rs.Header.Get("X-Request-Query"), transport.request.URL.RawQuery)
+	}
+}
+
+func Test_SymmetricKeyLength(t *testing.T) {
+	ts := newTestServer(t)
+	for _, version := range []int{ecthttp.ProtocolVersionCBC, ecthttp.ProtocolVersionGCM} {
+		hc, err := New(ts.URL+"/ectminfo", WithSymmetricKeyLength(utils.SymmetricKeyLen128), WithProtocolVersion(version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hc.SymmetricKey) != utils.SymmetricKeyLen128 {
+			t.Fatal("key length error:", len(hc.SymmetricKey))
+		}
+		result := hc.ECTPost(ts.URL+"/echo", []byte("token"), "body")
+		if result.Err != nil || result.ToString() != "token:body" {
+			t.Fatal(version, result.Err, result.ToString())
+		}
+	}
+
+	_, err := New(ts.URL+"/ectminfo", WithSymmetricKeyLength(24))
+	if err != ecthttp.ErrInvalidKeyLength {
+		t.Fatal("invalid key length accepted:", err)
+	}
+}
+
+func Test_Methods(t *testing.T) {
+	ts := newTestServer(t)
+	hc, err := New(ts.URL + "/ectminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		result := hc.ECTDo(method, ts.URL+"/echo", []byte("token"), "body")
+		if result.Err != nil || result.ToString() != "token:body" {
+			t.Fatal(method, result.Err, result.ToString())
+		}
+	}
+	result := hc.ECTDo("DELETE", ts.URL+"/echo", []byte("token"), nil)
+	if result.Err != nil || result.ToString() != "token:" {
+		t.Fatal(result.Err, result.ToString())
+	}
+
+	//a HEAD response has no body, its header is still verified
+	result = hc.ECTDo("HEAD", ts.URL+"/echo", []byte("token"), nil)
+	if result.Err != nil || len(result.DecryptedBody) != 0 || result.Rs.Header.Get("ectm_time") == "" {
+		t.Fatal(result.Err, result.ToString())
+	}
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	result = hc.ECTDo("HEAD", plain.URL, []byte("token"), nil)
+	if result.Err == nil {
+		t.Fatal("HEAD response without ectm header accepted")
+	}
+}
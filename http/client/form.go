@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+//FormFile is a file part of ECTPostForm
+type FormFile struct {
+	FieldName string
+	FileName  string
+	//application/octet-stream if ""
+	ContentType string
+	Reader      io.Reader
+}
+
+//ECTPostForm sends fields and files as multipart/form-data, the whole form including file names and content types is encrypted
+//the form is streamed while the files are read, so it is not sent again after a key renewal,
+//if streaming is off it is read into memory and sent as one encrypted body
+//the server reads it with r.MultipartReader() behind Middleware, or with server.MultipartReader
+func (hc *EctHttpClient) ECTPostForm(url string, Token []byte, fields url.Values, files []FormFile, v ...interface{}) *ecthttp.ECTResponse {
+	return hc.ECTPostFormCtx(context.Background(), url, Token, fields, files, v...)
+}
+
+//ECTPostFormCtx is ECTPostForm, ctx aborts the request and a key renewal it causes
+func (hc *EctHttpClient) ECTPostFormCtx(ctx context.Context, url string, Token []byte, fields url.Values, files []FormFile, v ...interface{}) *ecthttp.ECTResponse {
+	if !hc.streamsBody(-1) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		err := writeForm(mw, fields, files)
+		if err != nil {
+			return &ecthttp.ECTResponse{Rs: nil, DecryptedBody: nil, Err: err}
+		}
+		return hc.request(ctx, "POST", url, Token, &requestBody{data: buf.Bytes(), contentType: mw.FormDataContentType()}, v)
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeForm(mw, fields, files))
+	}()
+	result := hc.request(ctx, "POST", url, Token, &requestBody{stream: pr, contentType: mw.FormDataContentType()}, v)
+	//stops writeForm if the request ended before reading the whole form
+	pr.Close()
+	return result
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+//writeForm writes the fields, sorted by name, and the files as parts of mw and closes it
+func writeForm(mw *multipart.Writer, fields url.Values, files []FormFile) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range fields[name] {
+			err := mw.WriteField(name, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, file := range files {
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			quoteEscaper.Replace(file.FieldName), quoteEscaper.Replace(file.FileName)))
+		header.Set("Content-Type", contentType)
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, file.Reader)
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
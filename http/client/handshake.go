@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/utils"
+	"github.com/imroc/req"
+)
+
+//ErrHandshakeSignature means the handshake answer is not signed by the server public key
+var ErrHandshakeSignature = errors.New("handshake signature error")
+
+//handshake runs the ephemeral ECDH handshake against HandshakeUrl and returns the session keys
+//the server answer must be signed by serverKey
+func (hc *EctHttpClient) handshake(ctx context.Context, serverKey *serverKey) (*keyState, error) {
+	ephemeralKey, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	clientPublicKey := utils.PublicKeyToString(&ephemeralKey.PublicKey)
+
+	r := hc.newReq(hc.publicKeyTimeout)
+	response, err := r.Post(hc.HandshakeUrl, req.BodyJSON(&ecthttp.HandshakeRequest{
+		UnixTime:        time.Now().Unix(),
+		ClientPublicKey: clientPublicKey,
+		KeyId:           serverKey.keyId,
+	}), ctx)
+	if err != nil {
+		return nil, err
+	}
+	if response.Response().StatusCode != 200 {
+		return nil, responseError(response.Response(), response.Bytes())
+	}
+	var handshakeResponse ecthttp.HandshakeResponse
+	err = response.ToJSON(&handshakeResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	//time
+	err = ecthttp.CheckTimeGap(handshakeResponse.UnixTime, ecthttp.AllowServerClientTimeGap)
+	if err != nil {
+		return nil, err
+	}
+	//signature by the long-term key
+	sig, err := base64.StdEncoding.DecodeString(handshakeResponse.Signature)
+	if err != nil {
+		return nil, ErrHandshakeSignature
+	}
+	signMessage := ecthttp.HandshakeSignMessage(clientPublicKey, handshakeResponse.ServerPublicKey, handshakeResponse.SessionId, handshakeResponse.UnixTime)
+	if !utils.ECCVerify(serverKey.publicKey, signMessage, sig) {
+		return nil, ErrHandshakeSignature
+	}
+
+	serverPublicKey, err := utils.StrBase64ToPublicKey(handshakeResponse.ServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := utils.ECDHSharedSecret(ephemeralKey, serverPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	symmetricKey, err := ecthttp.DeriveSessionKey(sharedSecret, clientPublicKey, handshakeResponse.ServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyState{symmetricKey: symmetricKey, keyId: serverKey.keyId, sessionId: handshakeResponse.SessionId}, nil
+}
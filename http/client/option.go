@@ -0,0 +1,142 @@
+package client
+
+import (
+	"net/http"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//Option configures an EctHttpClient in New
+type Option func(hc *EctHttpClient)
+
+//WithSymmetricKeyLength sets the generated symmetric key length in bytes,
+//utils.SymmetricKeyLen128 or utils.SymmetricKeyLen256 (default), handshake sessions always use 256 bit
+func WithSymmetricKeyLength(keyLen int) Option {
+	return func(hc *EctHttpClient) {
+		hc.symmetricKeyLen = keyLen
+	}
+}
+
+//WithHandshake makes New run the ephemeral ECDH handshake against handshakeUrl
+//(the server ServeHandshake endpoint) instead of encrypting a symmetric key to the server public key,
+//so recorded traffic stays safe if the server private key leaks later
+func WithHandshake(handshakeUrl string) Option {
+	return func(hc *EctHttpClient) {
+		hc.HandshakeUrl = handshakeUrl
+	}
+}
+
+//WithSession makes New send the ecs key once to sessionUrl (the server ServeSession endpoint)
+//and use the returned session id in later requests, a new session is set up when the server lost it
+func WithSession(sessionUrl string) Option {
+	return func(hc *EctHttpClient) {
+		hc.SessionUrl = sessionUrl
+	}
+}
+
+//WithPublicKey uses a locally configured server public key, PublicKeyUrl is not fetched
+func WithPublicKey(publicKeyBase64Str string) Option {
+	return func(hc *EctHttpClient) {
+		hc.localPublicKey = publicKeyBase64Str
+	}
+}
+
+//WithPinnedPublicKey makes New fail with *PinError if PublicKeyUrl serves another public key
+//it is needed for old servers serving unsigned public key info, without a pin the client trusts on first use, see New
+func WithPinnedPublicKey(publicKeyBase64Str string) Option {
+	return func(hc *EctHttpClient) {
+		hc.pinnedPublicKey = publicKeyBase64Str
+	}
+}
+
+//WithIdentityFingerprint requires the public key info to be signed by the identity key
+//with this fingerprint (ecthttp.IdentityFingerprint), New fails with *PinError otherwise
+//without it the client trusts on first use the identity key of the first info it fetches, see New,
+//so anyone intercepting that fetch can make the client encrypt to their key
+func WithIdentityFingerprint(fingerprint string) Option {
+	return func(hc *EctHttpClient) {
+		hc.pinnedIdentityFingerprint = fingerprint
+	}
+}
+
+//WithTimeout limits every ECTGet and ECTPost, DefaultTimeout seconds if not set
+func WithTimeout(timeout time.Duration) Option {
+	return func(hc *EctHttpClient) {
+		hc.timeout = timeout
+	}
+}
+
+//WithProtocolVersion sends requests in version, by default the client uses the version of the server public key info,
+//ecthttp.ProtocolVersion with WithPublicKey
+func WithProtocolVersion(version int) Option {
+	return func(hc *EctHttpClient) {
+		hc.ProtocolVersion = version
+	}
+}
+
+//WithHTTPTransport sends the requests of the client with transport, e.g. an *http.Transport with a proxy or TLS config
+//it is used by ECTGet, ECTPost, the key setup, Subscribe and a Transport without Base, DialWebSocket dials itself
+func WithHTTPTransport(transport http.RoundTripper) Option {
+	return func(hc *EctHttpClient) {
+		hc.httpTransport = transport
+	}
+}
+
+//WithPublicKeyTimeout limits fetching the public key and the handshake, DefaultPublicKeyTimeout seconds if not set
+func WithPublicKeyTimeout(timeout time.Duration) Option {
+	return func(hc *EctHttpClient) {
+		hc.publicKeyTimeout = timeout
+	}
+}
+
+//WithEncryptedQuery sends the query string of requests in the encrypted ectm_query header instead of the url,
+//the server restores it before the handler runs
+func WithEncryptedQuery() Option {
+	return func(hc *EctHttpClient) {
+		hc.encryptQuery = true
+	}
+}
+
+//WithEncryptedHeaders sends the request headers with these names in the encrypted ectm_headers header,
+//the server restores them before the handler runs
+func WithEncryptedHeaders(names ...string) Option {
+	return func(hc *EctHttpClient) {
+		hc.encryptHeaders = append(hc.encryptHeaders, names...)
+	}
+}
+
+//WithStreamThreshold streams request bodies larger than threshold bytes in encrypted chunks,
+//ecthttp.DefaultStreamThreshold if not set, 0 never streams
+//the server must support streamed bodies
+func WithStreamThreshold(threshold int) Option {
+	return func(hc *EctHttpClient) {
+		hc.streamThreshold = threshold
+	}
+}
+
+//WithResponseBinding rejects responses that are not bound to their request with ecthttp.ErrResponseMismatch
+//Deprecated: ProtocolVersionGCM responses must be bound by default, see WithUnboundResponses
+func WithResponseBinding() Option {
+	return func(hc *EctHttpClient) {
+		hc.allowUnboundResponses = false
+	}
+}
+
+//WithUnboundResponses accepts ProtocolVersionGCM responses that are not bound to their request,
+//as sent by servers still using the deprecated server.ECTSendBack, they are rejected with ecthttp.ErrResponseMismatch by default
+//an unbound response may be replayed, so only set it during migration, ProtocolVersionCBC responses are never bound
+func WithUnboundResponses() Option {
+	return func(hc *EctHttpClient) {
+		hc.allowUnboundResponses = true
+	}
+}
+
+func defaultOptions(hc *EctHttpClient) {
+	hc.symmetricKeyLen = utils.SymmetricKeyLen256
+	hc.timeout = time.Duration(DefaultTimeout) * time.Second
+	hc.publicKeyTimeout = time.Duration(DefaultPublicKeyTimeout) * time.Second
+	hc.streamThreshold = ecthttp.DefaultStreamThreshold
+}
+
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+var ErrPublicKeyInfoSignature = errors.New("public key info signature error")
+
+//ErrPublicKeyFormat means the configured public key is not a valid ecc public key
+var ErrPublicKeyFormat = errors.New("public key format error")
+
+//ErrPublicKeyInfo means the fetched public key is invalid or does not match its key id
+var ErrPublicKeyInfo = errors.New("public key info error")
+
+//PinError is returned by New when the server keys do not match the pinned ones
+type PinError struct {
+	//"public key" or "identity fingerprint"
+	Kind     string
+	Expected string
+	Actual   string
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("pinned %s mismatch, expected:%s, actual:%s", e.Kind, e.Expected, e.Actual)
+}
+
+//getPublicKey returns the configured public key, or fetches it from PublicKeyUrl
+//and checks it against the pinned public key and identity fingerprint, or against trustedFingerprint if none is pinned
+//the identity fingerprint of the returned key is the one of the key that signed the info, "" if the info is not signed
+func (hc *EctHttpClient) getPublicKey(ctx context.Context, trustedFingerprint string) (*serverKey, error) {
+	if hc.localPublicKey != "" {
+		pubKey, err := utils.StrBase64ToPublicKey(hc.localPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if pubKey.X == nil {
+			return nil, ErrPublicKeyFormat
+		}
+		return &serverKey{publicKey: pubKey, keyId: utils.PublicKeyId(pubKey), protocolVersion: ecthttp.ProtocolVersion}, nil
+	}
+
+	r := hc.newReq(hc.publicKeyTimeout)
+	response, err := r.Do("GET", hc.PublicKeyUrl, ctx)
+	if err != nil {
+		return nil, err
+	}
+	var info ecthttp.PublicKeyInfo
+	err = response.ToJSON(&info)
+	if err != nil {
+		return nil, err
+	}
+
+	//time
+	err = ecthttp.CheckTimeGap(info.UnixTime, ecthttp.AllowServerClientTimeGap)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := hc.checkPublicKeyInfo(&info, trustedFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	//pubKey
+	pubKey, err := utils.StrBase64ToPublicKey(info.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if pubKey.X == nil || (info.KeyId != "" && info.KeyId != utils.PublicKeyId(pubKey)) {
+		return nil, ErrPublicKeyInfo
+	}
+
+	//old servers do not send their version, they only speak ProtocolVersionCBC
+	protocolVersion := info.ProtocolVersion
+	if protocolVersion == 0 {
+		protocolVersion = ecthttp.ProtocolVersionCBC
+	}
+	if protocolVersion > ecthttp.ProtocolVersion {
+		protocolVersion = ecthttp.ProtocolVersion
+	}
+	return &serverKey{publicKey: pubKey, keyId: utils.PublicKeyId(pubKey), identityFingerprint: fingerprint, protocolVersion: protocolVersion}, nil
+}
+
+//checkPublicKeyInfo verifies the signature of info and returns the fingerprint of the identity key that made it
+//the identity key must have the pinned fingerprint, without WithIdentityFingerprint the client trusts
+//the identity key of the first info it fetches and requires it in later fetches, e.g. after a key rotation
+//unsigned info, served by old servers, is only accepted with WithPinnedPublicKey
+func (hc *EctHttpClient) checkPublicKeyInfo(info *ecthttp.PublicKeyInfo, trustedFingerprint string) (string, error) {
+	if hc.pinnedPublicKey != "" && info.PublicKey != hc.pinnedPublicKey {
+		return "", &PinError{Kind: "public key", Expected: hc.pinnedPublicKey, Actual: info.PublicKey}
+	}
+
+	if info.Signature == "" {
+		if hc.pinnedPublicKey != "" && hc.pinnedIdentityFingerprint == "" {
+			return "", nil
+		}
+		return "", ErrPublicKeyInfoSignature
+	}
+
+	identityKey, err := utils.StrBase64ToPublicKey(info.IdentityKey)
+	if err != nil {
+		return "", ErrPublicKeyInfoSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(info.Signature)
+	if err != nil || !utils.ECCVerify(identityKey, ecthttp.PublicKeyInfoSignMessage(info), sig) {
+		return "", ErrPublicKeyInfoSignature
+	}
+
+	fingerprint, err := ecthttp.IdentityFingerprint(info.IdentityKey)
+	if err != nil {
+		return "", err
+	}
+	expected := hc.pinnedIdentityFingerprint
+	if expected == "" {
+		expected = trustedFingerprint
+	}
+	if expected != "" && !strings.EqualFold(fingerprint, expected) {
+		return "", &PinError{Kind: "identity fingerprint", Expected: expected, Actual: fingerprint}
+	}
+	return fingerprint, nil
+}
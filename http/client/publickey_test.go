@@ -0,0 +1,155 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//newSignedInfo returns the info of a new public key signed by identityKey
+func newSignedInfo(t *testing.T, identityKey *ecdsa.PrivateKey) *ecthttp.PublicKeyInfo {
+	priv, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &ecthttp.PublicKeyInfo{
+		UnixTime:    time.Now().Unix(),
+		PublicKey:   utils.PublicKeyToString(&priv.PublicKey),
+		KeyId:       utils.PublicKeyId(&priv.PublicKey),
+		IdentityKey: utils.PublicKeyToString(&identityKey.PublicKey),
+	}
+	sig, err := utils.ECCSign(identityKey, ecthttp.PublicKeyInfoSignMessage(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Signature = base64.StdEncoding.EncodeToString(sig)
+	return info
+}
+
+func Test_CheckPublicKeyInfo(t *testing.T) {
+	identityKey, _ := utils.GenSecp256k1KeyPair()
+	otherIdentityKey, _ := utils.GenSecp256k1KeyPair()
+	hc := &EctHttpClient{}
+
+	info := newSignedInfo(t, identityKey)
+	fingerprint, err := hc.checkPublicKeyInfo(info, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := ecthttp.IdentityFingerprint(info.IdentityKey)
+	if fingerprint != expected {
+		t.Fatal("fingerprint error")
+	}
+
+	//the identity key is signed too
+	swapped := *info
+	swapped.IdentityKey = utils.PublicKeyToString(&otherIdentityKey.PublicKey)
+	if _, err := hc.checkPublicKeyInfo(&swapped, ""); err != ErrPublicKeyInfoSignature {
+		t.Fatal("swapped identity key accepted:", err)
+	}
+
+	//after the first fetch only the trusted identity key is accepted
+	if _, err := hc.checkPublicKeyInfo(newSignedInfo(t, identityKey), fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hc.checkPublicKeyInfo(newSignedInfo(t, otherIdentityKey), fingerprint); err == nil {
+		t.Fatal("other identity key accepted")
+	}
+
+	//unsigned info only with a pinned public key
+	unsigned := &ecthttp.PublicKeyInfo{UnixTime: info.UnixTime, PublicKey: info.PublicKey}
+	if _, err := hc.checkPublicKeyInfo(unsigned, ""); err != ErrPublicKeyInfoSignature {
+		t.Fatal("unsigned info accepted:", err)
+	}
+	pinned := &EctHttpClient{pinnedPublicKey: info.PublicKey}
+	if _, err := pinned.checkPublicKeyInfo(unsigned, ""); err != nil {
+		t.Fatal(err)
+	}
+	pinned.pinnedIdentityFingerprint = fingerprint
+	if _, err := pinned.checkPublicKeyInfo(unsigned, ""); err != ErrPublicKeyInfoSignature {
+		t.Fatal("unsigned info accepted with pinned identity:", err)
+	}
+}
+
+func Test_DefaultProtocolVersion(t *testing.T) {
+	ts := newTestServer(t)
+	hc, err := New(ts.URL + "/ectminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.ProtocolVersion != ecthttp.ProtocolVersion {
+		t.Fatal("version error:", hc.ProtocolVersion)
+	}
+
+	//old servers serve unsigned info without a version
+	info, err := ts.hs.PublicKeyInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&ecthttp.PublicKeyInfo{UnixTime: time.Now().Unix(), PublicKey: info.PublicKey})
+	}))
+	defer old.Close()
+	hc, err = New(old.URL, WithPinnedPublicKey(info.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.ProtocolVersion != ecthttp.ProtocolVersionCBC {
+		t.Fatal("version error:", hc.ProtocolVersion)
+	}
+	hc, err = New(old.URL, WithPinnedPublicKey(info.PublicKey), WithProtocolVersion(ecthttp.ProtocolVersionGCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.ProtocolVersion != ecthttp.ProtocolVersionGCM {
+		t.Fatal("version error:", hc.ProtocolVersion)
+	}
+}
+
+func Test_PinnedKeys(t *testing.T) {
+	ts := newTestServer(t)
+	info, err := ts.hs.PublicKeyInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := utils.GenSecp256k1KeyPair()
+	otherPublicKey := utils.PublicKeyToString(&other.PublicKey)
+	otherFingerprint, _ := ecthttp.IdentityFingerprint(otherPublicKey)
+
+	var pinError *PinError
+	_, err = New(ts.URL+"/ectminfo", WithPinnedPublicKey(otherPublicKey))
+	if !errors.As(err, &pinError) || pinError.Kind != "public key" || pinError.Actual != info.PublicKey {
+		t.Fatal("other public key accepted:", err)
+	}
+	_, err = New(ts.URL+"/ectminfo", WithIdentityFingerprint(otherFingerprint))
+	if !errors.As(err, &pinError) || pinError.Kind != "identity fingerprint" {
+		t.Fatal("other identity accepted:", err)
+	}
+	fingerprint, _ := ecthttp.IdentityFingerprint(info.IdentityKey)
+	_, err = New(ts.URL+"/ectminfo", WithPinnedPublicKey(info.PublicKey), WithIdentityFingerprint(fingerprint))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//unsigned info is only trusted with a pinned public key
+	unsigned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&ecthttp.PublicKeyInfo{UnixTime: time.Now().Unix(), PublicKey: info.PublicKey})
+	}))
+	defer unsigned.Close()
+	_, err = New(unsigned.URL)
+	if err != ErrPublicKeyInfoSignature {
+		t.Fatal("unsigned info accepted:", err)
+	}
+	_, err = New(unsigned.URL, WithPinnedPublicKey(info.PublicKey), WithIdentityFingerprint(fingerprint))
+	if err != ErrPublicKeyInfoSignature {
+		t.Fatal("unsigned info accepted with pinned identity:", err)
+	}
+}
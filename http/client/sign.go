@@ -0,0 +1,86 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/imroc/req"
+)
+
+//signTransport sets ectm_sig on the final request, after req has added query params and body
+type signTransport struct {
+	base         http.RoundTripper
+	symmetricKey []byte
+	ectmHeader   *ecthttp.ECTMHeader
+	//its query and header options are applied after signing
+	hc *EctHttpClient
+	//the signature sent, to check the response binding
+	sig []byte
+	//set for a streamed body, the signature covers the stream id instead of the body
+	streamId []byte
+	//content type sent in the encrypted ectm_headers header, "" to send the plain one
+	contentType string
+}
+
+func (st *signTransport) RoundTrip(httpRequest *http.Request) (*http.Response, error) {
+	if st.streamId != nil {
+		signed := httpRequest.Clone(httpRequest.Context())
+		return st.send(signed, ecthttp.StreamSignBody(st.streamId))
+	}
+
+	var body []byte
+	if httpRequest.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(httpRequest.Body)
+		httpRequest.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signed := httpRequest.Clone(httpRequest.Context())
+	if httpRequest.Body != nil {
+		signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return st.send(signed, body)
+}
+
+//send signs signedBody and the encrypted headers into the header of signed and sends it
+func (st *signTransport) send(signed *http.Request, signedBody []byte) (*http.Response, error) {
+	var err error
+	if st.contentType != "" {
+		wireContentType := signed.Header.Get("Content-Type")
+		signed.Header.Set("Content-Type", st.contentType)
+		err = st.hc.protectHeaders(signed, st.symmetricKey, st.ectmHeader, "Content-Type")
+		signed.Header.Set("Content-Type", wireContentType)
+	} else {
+		err = st.hc.protectHeaders(signed, st.symmetricKey, st.ectmHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sig, err := ecthttp.SetRequestSignature(signed.Header, st.symmetricKey, signed.Method, signed.URL, st.ectmHeader, signedBody)
+	if err != nil {
+		return nil, err
+	}
+	st.sig = sig
+	err = st.hc.protectQuery(signed, st.symmetricKey, st.ectmHeader)
+	if err != nil {
+		return nil, err
+	}
+	return st.base.RoundTrip(signed)
+}
+
+//signWith makes r sign its requests with the values of ectmHeader
+func signWith(r *req.Req, hc *EctHttpClient, symmetricKey []byte, ectmHeader *ecthttp.ECTMHeader) *signTransport {
+	client := r.Client()
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	st := &signTransport{base: base, hc: hc, symmetricKey: symmetricKey, ectmHeader: ectmHeader}
+	client.Transport = st
+	return st
+}
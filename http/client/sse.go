@@ -0,0 +1,288 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+//DefaultEventRetry is the wait before reconnecting an event stream, until the server sends a retry field
+const DefaultEventRetry = 3 * time.Second
+
+var ErrNotEventStream = errors.New("response is not an encrypted event stream")
+
+//EventStream receives the events of an encrypted event stream, see Subscribe
+type EventStream struct {
+	//Events is closed when the stream ends, Err then tells why
+	Events <-chan *ecthttp.Event
+
+	hc          *EctHttpClient
+	url         string
+	token       []byte
+	ctx         context.Context
+	cancel      context.CancelFunc
+	events      chan *ecthttp.Event
+	done        chan struct{}
+	err         error
+	lastEventId uint64
+	retry       time.Duration
+}
+
+//Subscribe opens the encrypted event stream at url, sent by server.SSEWriter, and reconnects when the connection drops
+//events are checked to arrive in sequence, a reconnecting request sends Last-Event-ID so the server can go on from there
+//the stream ends when ctx is done, on Close, or on an error other than a dropped connection or a server error
+func (hc *EctHttpClient) Subscribe(ctx context.Context, url string, Token []byte) (*EventStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	events := make(chan *ecthttp.Event)
+	es := &EventStream{
+		Events: events,
+		hc:     hc,
+		url:    url,
+		token:  Token,
+		ctx:    ctx,
+		cancel: cancel,
+		events: events,
+		done:   make(chan struct{}),
+		retry:  DefaultEventRetry,
+	}
+
+	body, cipher, err := es.connect()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go es.run(body, cipher)
+	return es, nil
+}
+
+//Close ends the stream and waits for the connection to close
+func (es *EventStream) Close() {
+	es.cancel()
+	<-es.done
+}
+
+//Err returns why the stream ended once Events is closed, the ctx error after Close or when ctx is done
+func (es *EventStream) Err() error {
+	select {
+	case <-es.done:
+		return es.err
+	default:
+		return nil
+	}
+}
+
+func (es *EventStream) run(body io.ReadCloser, cipher *ecthttp.EventCipher) {
+	defer close(es.done)
+	defer close(es.events)
+	for {
+		err := es.read(body, cipher)
+		body.Close()
+		if es.ctx.Err() != nil {
+			es.err = es.ctx.Err()
+			return
+		}
+		if !reconnectable(err) {
+			es.err = err
+			return
+		}
+
+		for {
+			select {
+			case <-es.ctx.Done():
+				es.err = es.ctx.Err()
+				return
+			case <-time.After(es.retry):
+			}
+			body, cipher, err = es.connect()
+			if err == nil {
+				break
+			}
+			if es.ctx.Err() == nil && !reconnectable(err) {
+				es.err = err
+				return
+			}
+		}
+	}
+}
+
+//reconnectable tells if err is a dropped connection or a server error, after which the stream reconnects
+func reconnectable(err error) bool {
+	var netError net.Error
+	var statusError *ecthttp.StatusError
+	var remoteError *ecthttp.RemoteError
+	switch {
+	case err == io.EOF, err == io.ErrUnexpectedEOF, errors.As(err, &netError):
+		return true
+	case errors.As(err, &statusError):
+		return statusError.StatusCode >= 500
+	case errors.As(err, &remoteError):
+		return remoteError.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+//connect opens the stream with the current keys, and once more with new keys if the server lost them
+func (es *EventStream) connect() (io.ReadCloser, *ecthttp.EventCipher, error) {
+	state := es.hc.getKeyState()
+	body, cipher, err := es.open(state)
+	retry, renewErr := es.hc.renewOn(es.ctx, err, state)
+	if renewErr != nil {
+		return nil, nil, renewErr
+	}
+	if !retry {
+		return body, cipher, err
+	}
+	return es.open(es.hc.getKeyState())
+}
+
+//open sends the subscribe request with state and verifies the response header
+func (es *EventStream) open(state *keyState) (io.ReadCloser, *ecthttp.EventCipher, error) {
+	hc := es.hc
+	httpRequest, err := http.NewRequestWithContext(es.ctx, "GET", es.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpRequest.Header.Set("Accept", "text/event-stream")
+	httpRequest.Header.Set("Cache-Control", "no-cache")
+	if es.lastEventId != 0 {
+		httpRequest.Header.Set("Last-Event-ID", strconv.FormatUint(es.lastEventId, 10))
+	}
+	if es.token != nil {
+		httpRequest.Header.Set("ectm_token", string(es.token))
+	}
+
+	encrypted, ectmHeader, sig, err := hc.encryptRequest(httpRequest, nil, nil, state)
+	if err != nil {
+		return nil, nil, err
+	}
+	//the stream stays open, the client timeout only limits waiting for the response header
+	ctx, cancel := context.WithCancel(es.ctx)
+	var timer *time.Timer
+	if hc.timeout > 0 {
+		timer = time.AfterFunc(hc.timeout, cancel)
+	}
+	rs, err := hc.roundTripper().RoundTrip(encrypted.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if timer != nil && !timer.Stop() {
+		//the timeout fired as the response header arrived
+		rs.Body.Close()
+		cancel()
+		return nil, nil, context.DeadlineExceeded
+	}
+	rs.Body = readCloser{Reader: rs.Body, Closer: &bodyCloser{body: rs.Body, cancel: cancel}}
+	responseHeader, err := hc.verifyResponse(rs, state.symmetricKey, ectmHeader, sig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//the server answered with an error envelope instead of the stream
+	if responseHeader.Envelope {
+		defer rs.Body.Close()
+		err = hc.decryptResponseBody(rs, state.symmetricKey, responseHeader)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := ioutil.ReadAll(rs.Body)
+		if err != nil {
+			return nil, nil, ecthttp.ErrBody
+		}
+		return nil, nil, ecthttp.ParseRemoteError(rs.StatusCode, body)
+	}
+
+	streamId, err := ecthttp.GetEventStreamId(rs.Header)
+	if err == nil && streamId == nil {
+		err = ErrNotEventStream
+	}
+	if err != nil {
+		rs.Body.Close()
+		return nil, nil, err
+	}
+	//the events are bound to the request like the response header
+	cipher, err := ecthttp.NewEventCipher(state.symmetricKey, streamId, responseHeader.Bind)
+	if err != nil {
+		rs.Body.Close()
+		return nil, nil, err
+	}
+	return rs.Body, cipher, nil
+}
+
+//read decrypts and sends the events of one connection until it fails
+func (es *EventStream) read(body io.Reader, cipher *ecthttp.EventCipher) error {
+	reader := bufio.NewReader(body)
+	var id, event string
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		//a blank line ends the event
+		if line == "" {
+			if id != "" || len(data) != 0 {
+				err = es.dispatch(cipher, id, event, strings.Join(data, "\n"))
+				if err != nil {
+					return err
+				}
+			}
+			id, event, data = "", "", nil
+			continue
+		}
+		//comment
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			if milliseconds, err := strconv.Atoi(value); err == nil && milliseconds >= 0 {
+				es.retry = time.Duration(milliseconds) * time.Millisecond
+			}
+		}
+	}
+}
+
+//dispatch checks the event is the next in sequence, decrypts and sends it
+func (es *EventStream) dispatch(cipher *ecthttp.EventCipher, id string, event string, data string) error {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || seq != es.lastEventId+1 {
+		return fmt.Errorf("%w: expected event %d, got %q", ecthttp.ErrEventSequence, es.lastEventId+1, id)
+	}
+	plain, err := cipher.Open(seq, event, data)
+	if err != nil {
+		return err
+	}
+	es.lastEventId = seq
+
+	select {
+	case es.events <- &ecthttp.Event{Id: seq, Event: event, Data: plain}:
+		return nil
+	case <-es.ctx.Done():
+		return es.ctx.Err()
+	}
+}
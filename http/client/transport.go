@@ -0,0 +1,281 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+//protectHeaders encrypts the headers the client is configured to protect, and the headers in names
+//it runs before signing, the signature covers the encrypted headers
+func (hc *EctHttpClient) protectHeaders(httpRequest *http.Request, symmetricKey []byte, ectmHeader *ecthttp.ECTMHeader, names ...string) error {
+	encryptHeaders := hc.encryptHeaders
+	if len(names) != 0 {
+		encryptHeaders = append(append([]string{}, hc.encryptHeaders...), names...)
+	}
+	return ecthttp.SetEncryptedHeaders(httpRequest.Header, encryptHeaders, symmetricKey, ectmHeader)
+}
+
+//protectQuery encrypts the query if the client is configured to
+//it runs after signing, the signature covers the plain query
+func (hc *EctHttpClient) protectQuery(httpRequest *http.Request, symmetricKey []byte, ectmHeader *ecthttp.ECTMHeader) error {
+	if !hc.encryptQuery {
+		return nil
+	}
+	return ecthttp.SetEncryptedQuery(httpRequest.Header, httpRequest.URL, symmetricKey, ectmHeader.Version)
+}
+
+//Transport is an http.RoundTripper that encrypts requests and decrypts responses with the keys of Client,
+//so any *http.Client, e.g. &http.Client{Transport: hc.Transport()}, talks ECTSM
+//a plain ectm_token request header is sent as the encrypted token
+//bodies of unknown length or larger than the stream threshold are streamed, streamed responses are decrypted while read
+//responses that are not encrypted or fail verification are returned as errors
+type Transport struct {
+	Client *EctHttpClient
+	//Base sends the encrypted requests, the transport of Client if nil, see WithHTTPTransport
+	Base http.RoundTripper
+}
+
+//Transport returns a Transport using the keys of hc
+func (hc *EctHttpClient) Transport() *Transport {
+	return &Transport{Client: hc}
+}
+
+func (t *Transport) RoundTrip(httpRequest *http.Request) (*http.Response, error) {
+	if httpRequest.Body != nil && httpRequest.Body != http.NoBody {
+		//a length of 0 with a body means unknown
+		size := httpRequest.ContentLength
+		if size == 0 {
+			size = -1
+		}
+		if t.Client.streamsBody(size) {
+			return t.roundTripStream(httpRequest)
+		}
+	}
+
+	var data []byte
+	if httpRequest.Body != nil {
+		var err error
+		data, err = ioutil.ReadAll(httpRequest.Body)
+		httpRequest.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if httpRequest.Body == http.NoBody {
+			data = nil
+		} else if data == nil {
+			data = []byte{}
+		}
+	}
+
+	state := t.Client.getKeyState()
+	rs, err := t.roundTrip(httpRequest, data, nil, state)
+	retry, renewErr := t.Client.renewOn(httpRequest.Context(), err, state)
+	if renewErr != nil {
+		return nil, renewErr
+	}
+	if !retry {
+		return rs, err
+	}
+	return t.roundTrip(httpRequest, data, nil, t.Client.getKeyState())
+}
+
+//roundTripStream sends the body of httpRequest streamed, it is sent again after a key renewal only if GetBody is set
+func (t *Transport) roundTripStream(httpRequest *http.Request) (*http.Response, error) {
+	state := t.Client.getKeyState()
+	rs, err := t.roundTrip(httpRequest, nil, httpRequest.Body, state)
+	retry, renewErr := t.Client.renewOn(httpRequest.Context(), err, state)
+	if renewErr != nil {
+		return nil, renewErr
+	}
+	if !retry || httpRequest.GetBody == nil {
+		return rs, err
+	}
+	body, bodyErr := httpRequest.GetBody()
+	if bodyErr != nil {
+		return nil, err
+	}
+	return t.roundTrip(httpRequest, nil, body, t.Client.getKeyState())
+}
+
+//readCloser reads from Reader and closes Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+//roundTrip sends httpRequest with data as body encrypted with state, data and stream are nil for requests without body
+//a stream is sent in encrypted chunks instead of data, it is closed
+func (t *Transport) roundTrip(httpRequest *http.Request, data []byte, stream io.ReadCloser, state *keyState) (*http.Response, error) {
+	hc := t.Client
+	encrypted, ectmHeader, sig, err := hc.encryptRequest(httpRequest, data, stream, state)
+	if err != nil {
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = hc.roundTripper()
+	}
+	rs, err := base.RoundTrip(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hc.decryptResponse(rs, state.symmetricKey, ectmHeader, sig)
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+//encryptRequest returns a copy of httpRequest with the ectm headers, the signature and the encrypted body
+//it also returns the request header and signature, to verify the response
+func (hc *EctHttpClient) encryptRequest(httpRequest *http.Request, data []byte, stream io.ReadCloser, state *keyState) (*http.Request, *ecthttp.ECTMHeader, []byte, error) {
+	encrypted := httpRequest.Clone(httpRequest.Context())
+	var Token []byte
+	if token := encrypted.Header.Get("ectm_token"); token != "" {
+		Token = []byte(token)
+	}
+	encrypted.Header.Del("ectm_token")
+
+	ecsKey := setKeyHeader(encrypted.Header, state)
+	ectmHeader := &ecthttp.ECTMHeader{Version: hc.ProtocolVersion, Token: Token}
+	err := ecthttp.SetECTMHeader(encrypted.Header, ecsKey, state.symmetricKey, ectmHeader)
+	if err != nil {
+		if stream != nil {
+			stream.Close()
+		}
+		return nil, nil, nil, err
+	}
+	if hc.ProtocolVersion != ecthttp.ProtocolVersionCBC {
+		ecthttp.SetAcceptStream(encrypted.Header)
+	}
+
+	var body []byte
+	if stream != nil {
+		streamId, err := ecthttp.NewStreamId()
+		if err != nil {
+			stream.Close()
+			return nil, nil, nil, err
+		}
+		encryptReader, err := ecthttp.NewEncryptReader(stream, state.symmetricKey, streamId, nil)
+		if err != nil {
+			stream.Close()
+			return nil, nil, nil, err
+		}
+		ecthttp.SetStreamHeader(encrypted.Header, streamId)
+		encrypted.Header.Del("Content-Length")
+		encrypted.Body = readCloser{Reader: encryptReader, Closer: stream}
+		encrypted.GetBody = nil
+		encrypted.ContentLength = -1
+		//the chunks are bound to the stream id
+		body = ecthttp.StreamSignBody(streamId)
+	} else if data != nil {
+		body, err = ecthttp.EncryptBodyWithVersion(data, state.symmetricKey, hc.ProtocolVersion)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		encrypted.Body = ioutil.NopCloser(bytes.NewReader(body))
+		encrypted.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		encrypted.ContentLength = int64(len(body))
+	}
+	err = hc.protectHeaders(encrypted, state.symmetricKey, ectmHeader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sig, err := ecthttp.SetRequestSignature(encrypted.Header, state.symmetricKey, encrypted.Method, encrypted.URL, ectmHeader, body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = hc.protectQuery(encrypted, state.symmetricKey, ectmHeader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return encrypted, ectmHeader, sig, nil
+}
+
+//decryptResponse verifies rs and replaces its body with the decrypted body
+//encrypted responses are decrypted whatever their status code
+func (hc *EctHttpClient) decryptResponse(rs *http.Response, symmetricKey []byte, requestHeader *ecthttp.ECTMHeader, sig []byte) error {
+	responseHeader, err := hc.verifyResponse(rs, symmetricKey, requestHeader, sig)
+	if err != nil {
+		return err
+	}
+	err = hc.decryptResponseBody(rs, symmetricKey, responseHeader)
+	if err != nil {
+		rs.Body.Close()
+		return err
+	}
+	return nil
+}
+
+//verifyResponse checks the response header and restores the encrypted headers, the body of rs is closed on error
+func (hc *EctHttpClient) verifyResponse(rs *http.Response, symmetricKey []byte, requestHeader *ecthttp.ECTMHeader, sig []byte) (*ecthttp.ECTMHeader, error) {
+	//an error envelope is decrypted like any other response
+	if code := ecthttp.GetErrorCode(rs.Header); code != "" && code != ecthttp.ErrorCodeEnvelope {
+		return nil, plainResponseError(rs)
+	}
+	responseHeader, err := hc.checkResponseHeader(rs.Header, symmetricKey, requestHeader, sig)
+	if err != nil {
+		if rs.StatusCode < 200 || rs.StatusCode > 299 {
+			return nil, plainResponseError(rs)
+		}
+		rs.Body.Close()
+		return nil, err
+	}
+	err = ecthttp.RestoreEncryptedHeaders(rs.Header, symmetricKey, responseHeader)
+	if err != nil {
+		rs.Body.Close()
+		return nil, err
+	}
+	return responseHeader, nil
+}
+
+//decryptResponseBody replaces the body of rs with the decrypted body, a streamed body is decrypted while read
+func (hc *EctHttpClient) decryptResponseBody(rs *http.Response, symmetricKey []byte, responseHeader *ecthttp.ECTMHeader) error {
+	streamId, err := ecthttp.GetStreamId(rs.Header)
+	if err != nil {
+		return err
+	}
+	if streamId != nil {
+		//the chunks are bound to the request like the response header
+		decryptReader, err := ecthttp.NewDecryptReader(rs.Body, symmetricKey, streamId, ecthttp.ResponseAdditionalData(responseHeader))
+		if err != nil {
+			return err
+		}
+		rs.Body = readCloser{Reader: decryptReader, Closer: rs.Body}
+		rs.ContentLength = -1
+		rs.Header.Del("Content-Length")
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(rs.Body)
+	if err != nil {
+		return ecthttp.ErrBody
+	}
+	decryptBody, err := ecthttp.DecryptResponseBody(body, symmetricKey, responseHeader)
+	if err != nil {
+		return &ecthttp.DecryptError{Stage: ecthttp.DecryptStageBody, Err: err}
+	}
+	rs.Body.Close()
+	rs.Body = ioutil.NopCloser(bytes.NewReader(decryptBody))
+	rs.ContentLength = int64(len(decryptBody))
+	rs.Header.Del("Content-Length")
+	return nil
+}
+
+//plainResponseError reads and closes the body of a response the server did not encrypt and returns its error
+func plainResponseError(rs *http.Response) error {
+	body, err := ioutil.ReadAll(rs.Body)
+	rs.Body.Close()
+	if err != nil {
+		return ecthttp.ErrBody
+	}
+	return responseError(rs, body)
+}
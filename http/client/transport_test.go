@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_Transport(t *testing.T) {
+	ts := newTestServer(t)
+	hc, err := New(ts.URL+"/ectminfo", WithSession(ts.URL+"/session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{Transport: hc.Transport()}
+
+	rq, _ := http.NewRequest("POST", ts.URL+"/echo", strings.NewReader("body"))
+	rq.Header.Set("ectm_token", "token")
+	rs, err := httpClient.Do(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(rs.Body)
+	rs.Body.Close()
+	if rs.StatusCode != http.StatusOK || string(body) != "token:body" {
+		t.Fatal(rs.StatusCode, string(body))
+	}
+	//the response headers are checked and the body length is the decrypted one
+	if rs.Header.Get("ectm_time") == "" || rs.ContentLength != int64(len(body)) {
+		t.Fatal(rs.Header, rs.ContentLength)
+	}
+
+	//the body is sent again after the session is renewed
+	ts.hs.RevokeSession(hc.SessionId)
+	rs, err = httpClient.Post(ts.URL+"/echo", "text/plain", bytes.NewReader([]byte("again")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(rs.Body)
+	rs.Body.Close()
+	if string(body) != ":again" || rs.Header.Get("X-Request-Length") != "5" {
+		t.Fatal(string(body), rs.Header.Get("X-Request-Length"))
+	}
+
+	//a body of unknown length is streamed
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 100; i++ {
+			pw.Write(bytes.Repeat([]byte("x"), 1000))
+		}
+		pw.Close()
+	}()
+	rs, err = httpClient.Post(ts.URL+"/echo", "text/plain", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(rs.Body)
+	rs.Body.Close()
+	if string(body) != ":"+strings.Repeat("x", 100000) || rs.Header.Get("X-Request-Length") != "-1" {
+		t.Fatal("streamed body error", len(body), rs.Header.Get("X-Request-Length"))
+	}
+
+	//responses that are not encrypted are errors
+	_, err = httpClient.Get(ts.URL + "/ectminfo")
+	if err == nil {
+		t.Fatal("plain response accepted")
+	}
+}
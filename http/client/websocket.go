@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"golang.org/x/net/websocket"
+)
+
+//ErrWebSocketScheme means the url given to DialWebSocket is not ws:// or wss://
+var ErrWebSocketScheme = errors.New("websocket url scheme must be ws or wss")
+
+//DialWebSocket opens an encrypted websocket channel to wsUrl (ws:// or wss://), served by server.WebSocketHandler
+//the upgrade request is signed like an ECTGet of wsUrl, ctx and the client timeout limit the dial and the handshake
+func (hc *EctHttpClient) DialWebSocket(ctx context.Context, wsUrl string, Token []byte) (*ecthttp.WebSocketConn, error) {
+	state := hc.getKeyState()
+	conn, err := hc.dialWebSocket(ctx, wsUrl, Token, state)
+	retry, renewErr := hc.renewOn(ctx, err, state)
+	if renewErr != nil {
+		return nil, renewErr
+	}
+	if !retry {
+		return conn, err
+	}
+	return hc.dialWebSocket(ctx, wsUrl, Token, hc.getKeyState())
+}
+
+func (hc *EctHttpClient) dialWebSocket(ctx context.Context, wsUrl string, Token []byte, state *keyState) (*ecthttp.WebSocketConn, error) {
+	location, err := url.Parse(wsUrl)
+	if err != nil {
+		return nil, err
+	}
+	if location.Scheme != "ws" && location.Scheme != "wss" {
+		return nil, ErrWebSocketScheme
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, "GET", wsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if Token != nil {
+		httpRequest.Header.Set("ectm_token", string(Token))
+	}
+	encrypted, ectmHeader, sig, err := hc.encryptRequest(httpRequest, nil, nil, state)
+	if err != nil {
+		return nil, err
+	}
+
+	origin := &url.URL{Scheme: "http", Host: location.Host}
+	if location.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	config, err := websocket.NewConfig(encrypted.URL.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Header = encrypted.Header
+
+	netConn, err := dialWebSocketConn(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	//abort the handshake when ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-stop:
+		}
+	}()
+	if hc.timeout > 0 {
+		netConn.SetDeadline(time.Now().Add(hc.timeout))
+	}
+
+	recorder := &handshakeRecorder{Conn: netConn}
+	ws, err := websocket.NewClient(config, recorder)
+	if err != nil {
+		netConn.Close()
+		return nil, recorder.handshakeError(err)
+	}
+	conn, err := ecthttp.NewClientWebSocketConn(ws, state.symmetricKey, ecthttp.RequestDigest(ectmHeader.Nonce, sig))
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		ws.Close()
+		return nil, ctx.Err()
+	}
+	netConn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+//dialWebSocketConn opens the tcp or tls connection to location
+func dialWebSocketConn(ctx context.Context, location *url.URL) (net.Conn, error) {
+	host := location.Host
+	if location.Port() == "" {
+		if location.Scheme == "wss" {
+			host = net.JoinHostPort(location.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(location.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{}
+	if location.Scheme == "wss" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: location.Hostname()}}
+		return tlsDialer.DialContext(ctx, "tcp", host)
+	}
+	return dialer.DialContext(ctx, "tcp", host)
+}
+
+//handshakeRecorder keeps what is read until the end of the handshake response header,
+//x/net/websocket does not return the response of a failed handshake
+type handshakeRecorder struct {
+	net.Conn
+	buf  bytes.Buffer
+	done bool
+}
+
+const maxHandshakeRecord = 64 * 1024
+
+func (hr *handshakeRecorder) Read(p []byte) (int, error) {
+	n, err := hr.Conn.Read(p)
+	if !hr.done {
+		hr.buf.Write(p[:n])
+		hr.done = bytes.Contains(hr.buf.Bytes(), []byte("\r\n\r\n")) || hr.buf.Len() > maxHandshakeRecord
+	}
+	return n, err
+}
+
+//handshakeError returns the error of the recorded response, e.g. ecthttp.ErrUnknownSession, err if there is none
+func (hr *handshakeRecorder) handshakeError(err error) error {
+	rs, readErr := http.ReadResponse(bufio.NewReader(bytes.NewReader(hr.buf.Bytes())), nil)
+	if readErr != nil || rs.StatusCode == http.StatusSwitchingProtocols {
+		return err
+	}
+	//the body may be cut off
+	body, _ := ioutil.ReadAll(rs.Body)
+	return responseError(rs, body)
+}
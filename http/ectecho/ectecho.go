@@ -0,0 +1,176 @@
+//Package ectecho plugs EctHttpServer into labstack/echo
+package ectecho
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/http/server"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+//messageHeaders are the ectm_* headers of both requests and responses
+//header names are case-insensitive, also in CORS, so each is listed once
+var messageHeaders = []string{"Ectm_version", "Ectm_time", "Ectm_nonce", "Ectm_headers", "Ectm_stream"}
+
+//RequestHeaders are the ectm_* headers a client sends
+var RequestHeaders = append([]string{
+	"Ectm_key", "Ectm_kid", "Ectm_session", "Ectm_token", "Ectm_sig", "Ectm_query", "Ectm_stream_accept",
+}, messageHeaders...)
+
+//ResponseHeaders are the ectm_* headers a client reads from the response
+var ResponseHeaders = append([]string{
+	"Ectm_bind", "Ectm_error", "Ectm_events",
+}, messageHeaders...)
+
+const requestContextKey = "ectm_request"
+
+var ErrNoRequest = errors.New("no ectm request in context")
+
+//Middleware decrypts the request before the handler runs and encrypts whatever the handler writes,
+//so c.JSON, c.String and c.Blob send encrypted responses
+//requests that fail to decrypt are answered by hs.ErrorHandler and do not reach the handler
+func Middleware(hs *server.EctHttpServer) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ectRq := hs.HandleStream(c.Request())
+			if ectRq.Err != nil {
+				hs.HandleError(c.Response(), ectRq)
+				return nil
+			}
+
+			c.SetRequest(server.WithECTRequest(c.Request(), ectRq))
+			c.Set(requestContextKey, ectRq)
+
+			res := c.Response()
+			w := res.Writer
+			rw := hs.NewResponseWriter(w, ectRq)
+			res.Writer = rw
+			defer func() {
+				res.Writer = w
+			}()
+
+			//handle the error here, so the error response is encrypted too
+			if err := next(c); err != nil && !res.Committed {
+				httpError(c, err)
+			}
+			return rw.Close()
+		}
+	}
+}
+
+//httpError answers an error returned by the handler with an error envelope, instead of the echo HTTPErrorHandler
+//the message of errors other than *echo.HTTPError is not sent, like in the echo default handler
+func httpError(c echo.Context, err error) {
+	he, ok := err.(*echo.HTTPError)
+	if !ok {
+		he = echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	server.SendError(c.Response(), he.Code, &ecthttp.ErrorEnvelope{Message: fmt.Sprint(he.Message)})
+}
+
+//Error sends an encrypted error envelope, the client gets it as *ecthttp.RemoteError
+func Error(c echo.Context, statusCode int, code string, message string, details interface{}) error {
+	return server.SendError(c.Response(), statusCode, &ecthttp.ErrorEnvelope{Code: code, Message: message, Details: details})
+}
+
+//SSE starts an encrypted event stream answering the request, the handler sends the events with the returned writer
+func SSE(c echo.Context) (*server.SSEWriter, error) {
+	ectRq := Request(c)
+	if ectRq == nil {
+		return nil, ErrNoRequest
+	}
+	res := c.Response()
+	sw, err := server.NewSSEWriter(res.Writer, ectRq)
+	if err != nil {
+		return nil, err
+	}
+	//echo must not write an error response into the stream
+	res.Committed = true
+	return sw, nil
+}
+
+//Request returns the decrypted request put in c by Middleware, nil if none
+func Request(c echo.Context) *ecthttp.ECTRequest {
+	ectRq, _ := c.Get(requestContextKey).(*ecthttp.ECTRequest)
+	return ectRq
+}
+
+//Token returns the decrypted ectm_token of the request
+func Token(c echo.Context) []byte {
+	ectRq := Request(c)
+	if ectRq == nil {
+		return nil
+	}
+	return ectRq.Token
+}
+
+//SymmetricKey returns the symmetric key of the request
+func SymmetricKey(c echo.Context) []byte {
+	ectRq := Request(c)
+	if ectRq == nil {
+		return nil
+	}
+	return ectRq.SymmetricKey
+}
+
+//Body returns the decrypted request body, nil for a streamed body
+//read streamed bodies from c.Request().Body
+func Body(c echo.Context) []byte {
+	ectRq := Request(c)
+	if ectRq == nil {
+		return nil
+	}
+	return ectRq.DecryptedBody
+}
+
+//Bind unmarshals the decrypted json body into v
+func Bind(c echo.Context, v interface{}) error {
+	ectRq := Request(c)
+	if ectRq == nil {
+		return ErrNoRequest
+	}
+	if ectRq.BodyReader != nil {
+		return json.NewDecoder(c.Request().Body).Decode(v)
+	}
+	return json.Unmarshal(ectRq.DecryptedBody, v)
+}
+
+//MultipartReader returns a reader of the decrypted parts of a form sent by EctHttpClient.ECTPostForm
+func MultipartReader(c echo.Context) (*multipart.Reader, error) {
+	ectRq := Request(c)
+	if ectRq == nil {
+		return nil, ErrNoRequest
+	}
+	return server.MultipartReader(ectRq)
+}
+
+//PublicKeyInfoHandler is hs.ServePublicKeyInfo for echo routes
+func PublicKeyInfoHandler(hs *server.EctHttpServer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		info, err := hs.PublicKeyInfo()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		c.Response().Header().Set("Cache-Control", "no-store")
+		return c.JSON(http.StatusOK, info)
+	}
+}
+
+//CORSConfig allows the ectm_* request headers and exposes the ectm_* response headers to browsers
+func CORSConfig() middleware.CORSConfig {
+	config := middleware.DefaultCORSConfig
+	config.AllowHeaders = append([]string{echo.HeaderContentType}, RequestHeaders...)
+	config.ExposeHeaders = ResponseHeaders
+	return config
+}
+
+//CORS returns the echo CORS middleware with CORSConfig
+func CORS() echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(CORSConfig())
+}
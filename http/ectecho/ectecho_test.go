@@ -0,0 +1,84 @@
+package ectecho
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/http/client"
+	"github.com/daqnext/ECTSM-go/http/server"
+	"github.com/daqnext/ECTSM-go/utils"
+	"github.com/labstack/echo/v4"
+)
+
+func Test_Middleware(t *testing.T) {
+	privateKey, _, err := utils.GenAndPrintEccKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := server.New(privateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(CORS())
+	e.GET("/ectminfo", PublicKeyInfoHandler(hs))
+	g := e.Group("/ectm", Middleware(hs))
+	g.POST("/bind", func(c echo.Context) error {
+		var v struct{ Name string }
+		err := Bind(c, &v)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]string{"Name": v.Name, "Token": string(Token(c)), "Body": string(Body(c))})
+	})
+	g.GET("/error", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusTeapot, "teapot")
+	})
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+
+	hc, err := client.New(ts.URL + "/ectminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := hc.ECTPost(ts.URL+"/ectm/bind", []byte("token"), map[string]string{"Name": "name"})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	expected := `{"Body":"{\"Name\":\"name\"}","Name":"name","Token":"token"}` + "\n"
+	if result.ToString() != expected {
+		t.Fatal(result.ToString())
+	}
+
+	//handler errors are encrypted envelopes
+	result = hc.ECTGet(ts.URL+"/ectm/error", nil)
+	var remoteError *ecthttp.RemoteError
+	if !errors.As(result.Err, &remoteError) || remoteError.StatusCode != http.StatusTeapot || remoteError.Message != "teapot" {
+		t.Fatal(result.Err)
+	}
+
+	//plain requests do not reach the handler
+	rs, err := http.Post(ts.URL+"/ectm/bind", "application/json", strings.NewReader(`{"Name":"name"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	if rs.StatusCode != http.StatusBadRequest {
+		t.Fatal("plain request accepted", rs.StatusCode)
+	}
+
+	//browsers may send and read the ectm headers
+	rq := httptest.NewRequest("OPTIONS", "/ectm/bind", nil)
+	rq.Header.Set("Origin", "http://example.com")
+	rq.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, rq)
+	if !strings.Contains(rec.Header().Get("Access-Control-Allow-Headers"), "Ectm_sig") {
+		t.Fatal(rec.Header())
+	}
+}
@@ -0,0 +1,177 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//error codes sent in the plain ectm_error response header
+//the client can react on them even when it can not decrypt the response
+const (
+	ErrorCodeUnknownSession = "unknown_session"
+	ErrorCodeUnknownKey     = "unknown_key"
+)
+
+var ErrUnknownSession = errors.New("session not exist")
+
+//ErrUnknownKey means the server does not have (any more) the private key the client encrypted to
+var ErrUnknownKey = errors.New("unknown server key")
+
+//ErrMissingKey means a request has neither ectm_key nor ectm_session
+var ErrMissingKey = errors.New("ecs not exist")
+var ErrMissingTimestamp = errors.New("timestamp not exist")
+
+//ErrMissingNonce means a nonce is required, e.g. for replay protection, but the request has none
+var ErrMissingNonce = errors.New("nonce not exist")
+var ErrInvalidKeyLength = errors.New("symmetric key length error")
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+//ErrLegacyProtocol means the server rejects ProtocolVersionCBC requests
+var ErrLegacyProtocol = errors.New("legacy protocol version rejected")
+
+//ErrVersionMismatch means the response is not in the protocol version of the request
+var ErrVersionMismatch = errors.New("response protocol version mismatch")
+
+//ErrBody means reading a body failed
+var ErrBody = errors.New("body error")
+
+//ErrClockSkew is matched by every *ClockSkewError
+var ErrClockSkew = errors.New("time Gap error")
+
+//ClockSkewError means a timestamp is too far from the local time
+type ClockSkewError struct {
+	//local time minus the timestamp, in seconds
+	Gap int64
+}
+
+func (e *ClockSkewError) Error() string {
+	return fmt.Sprintf("time Gap error, gap:%ds", e.Gap)
+}
+
+func (e *ClockSkewError) Is(target error) bool {
+	return target == ErrClockSkew
+}
+
+//CheckTimeGap returns a *ClockSkewError if unixTime is more than allowGapSec from now
+func CheckTimeGap(unixTime int64, allowGapSec int64) error {
+	timeGap := time.Now().Unix() - unixTime
+	if timeGap < -allowGapSec || timeGap > allowGapSec {
+		return &ClockSkewError{Gap: timeGap}
+	}
+	return nil
+}
+
+//ErrDecrypt is matched by every *DecryptError
+var ErrDecrypt = errors.New("decrypt error")
+
+//stages of DecryptError
+const (
+	DecryptStageKey       = "ecs"
+	DecryptStageTimestamp = "timestamp"
+	DecryptStageNonce     = "nonce"
+	DecryptStageToken     = "token"
+	DecryptStageBind      = "bind"
+	DecryptStageQuery     = "query"
+	DecryptStageHeaders   = "headers"
+	DecryptStageBody      = "body"
+)
+
+//DecryptError means a value could not be decoded or decrypted, Stage tells which one
+type DecryptError struct {
+	Stage string
+	//the underlying error, e.g. a base64 or cipher error, may be nil
+	Err error
+}
+
+func (e *DecryptError) Error() string {
+	if e.Err == nil {
+		return "decrypt " + e.Stage + " error"
+	}
+	return "decrypt " + e.Stage + " error: " + e.Err.Error()
+}
+
+func (e *DecryptError) Is(target error) bool {
+	return target == ErrDecrypt
+}
+
+func (e *DecryptError) Unwrap() error {
+	return e.Err
+}
+
+//ErrEncrypt is matched by every *EncryptError
+var ErrEncrypt = errors.New("encrypt error")
+
+//stages of EncryptError, the others are shared with DecryptError
+const (
+	EncryptStageHeader = "header"
+)
+
+//EncryptError means a value could not be encoded or encrypted, Stage tells which one
+type EncryptError struct {
+	Stage string
+	//the underlying error, e.g. a json or cipher error, may be nil
+	Err error
+}
+
+func (e *EncryptError) Error() string {
+	if e.Err == nil {
+		return "encrypt " + e.Stage + " error"
+	}
+	return "encrypt " + e.Stage + " error: " + e.Err.Error()
+}
+
+func (e *EncryptError) Is(target error) bool {
+	return target == ErrEncrypt
+}
+
+func (e *EncryptError) Unwrap() error {
+	return e.Err
+}
+
+//StatusError is returned for a response with an error status the client could not decrypt
+//it unwraps to the error of its ectm_error code, e.g. ErrUnknownKey
+type StatusError struct {
+	StatusCode int
+	//the ectm_error header, "" if not set
+	Code string
+	Body []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("response status error,status code:%d,content:%s", e.StatusCode, string(e.Body))
+}
+
+func (e *StatusError) Unwrap() error {
+	return ErrorFromCode(e.Code)
+}
+
+//ErrorCode returns the error code for err, "" if err has none
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownSession):
+		return ErrorCodeUnknownSession
+	case errors.Is(err, ErrUnknownKey):
+		return ErrorCodeUnknownKey
+	default:
+		return ""
+	}
+}
+
+//ErrorFromCode is the reverse of ErrorCode, nil for unknown codes
+func ErrorFromCode(code string) error {
+	switch code {
+	case ErrorCodeUnknownSession:
+		return ErrUnknownSession
+	case ErrorCodeUnknownKey:
+		return ErrUnknownKey
+	default:
+		return nil
+	}
+}
+
+//GetErrorCode reads the ectm_error header of a response
+func GetErrorCode(header http.Header) string {
+	return header.Get("ectm_error")
+}
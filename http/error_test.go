@@ -0,0 +1,45 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_ErrorTypes(t *testing.T) {
+	key := []byte("1234567890abcdef1234567890abcdef")
+
+	//a request from 10 minutes ago
+	header := make(http.Header)
+	err := SetECTMHeader(header, nil, key, &ECTMHeader{UnixTime: time.Now().Unix() - 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseECTMHeader(header, key)
+	var clockSkewErr *ClockSkewError
+	if !errors.Is(err, ErrClockSkew) || !errors.As(err, &clockSkewErr) || clockSkewErr.Gap < 600 {
+		t.Fatal("expected clock skew error:", err)
+	}
+
+	header = make(http.Header)
+	err = SetECTMHeader(header, nil, key, &ECTMHeader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseECTMHeader(header, []byte("abcdef1234567890abcdef1234567890"))
+	var decryptErr *DecryptError
+	if !errors.Is(err, ErrDecrypt) || !errors.As(err, &decryptErr) || decryptErr.Stage != DecryptStageTimestamp {
+		t.Fatal("expected decrypt error:", err)
+	}
+
+	_, err = ParseECTMHeader(make(http.Header), key)
+	if !errors.Is(err, ErrMissingTimestamp) {
+		t.Fatal("expected missing timestamp:", err)
+	}
+
+	var statusErr error = &StatusError{StatusCode: 401, Code: ErrorCodeUnknownKey}
+	if !errors.Is(statusErr, ErrUnknownKey) || errors.Is(statusErr, ErrUnknownSession) {
+		t.Fatal("status error does not unwrap to its code")
+	}
+}
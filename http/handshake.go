@@ -0,0 +1,44 @@
+package http
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//HandshakeRequest is posted as json by the client to the handshake endpoint
+type HandshakeRequest struct {
+	UnixTime        int64
+	ClientPublicKey string
+	//id of the server key expected to sign the response, the current key if empty
+	KeyId string
+}
+
+//HandshakeResponse is the json answer of the handshake endpoint
+//Signature is made by the server private key KeyId over HandshakeSignMessage
+type HandshakeResponse struct {
+	UnixTime        int64
+	ServerPublicKey string
+	SessionId       string
+	Signature       string
+}
+
+const handshakeKeyInfo = "ECTSM handshake session key"
+
+//HandshakeSignMessage is the message signed by the server, it binds both ephemeral keys to the session id
+func HandshakeSignMessage(clientPublicKey string, serverPublicKey string, sessionId string, unixTime int64) []byte {
+	return []byte(strings.Join([]string{
+		"ECTSM handshake",
+		clientPublicKey,
+		serverPublicKey,
+		sessionId,
+		strconv.FormatInt(unixTime, 10),
+	}, "\n"))
+}
+
+//DeriveSessionKey derives the symmetric key from the ECDH shared secret of both ephemeral keys
+func DeriveSessionKey(sharedSecret []byte, clientPublicKey string, serverPublicKey string) ([]byte, error) {
+	salt := []byte(clientPublicKey + serverPublicKey)
+	return utils.DeriveKey(sharedSecret, salt, handshakeKeyInfo, utils.SymmetricKeyLen256)
+}
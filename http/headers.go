@@ -0,0 +1,109 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//headerEnvelope is the encrypted json of the ectm_headers header
+//Nonce is the ectm_nonce of the message, so the envelope can not be moved to another message
+type headerEnvelope struct {
+	Nonce  []byte
+	Header http.Header
+}
+
+//ErrPlainHeader means a request header the server only accepts in the encrypted ectm_headers header was sent plain
+var ErrPlainHeader = errors.New("header must be encrypted")
+
+//SetEncryptedHeaders moves the headers in names into the encrypted ectm_headers header and sets ectmHeader.EncryptedHeaders
+//it must be called after SetECTMHeader, the envelope is bound to ectmHeader.Nonce, and before signing a request
+func SetEncryptedHeaders(header http.Header, names []string, symmetricKey []byte, ectmHeader *ECTMHeader) error {
+	header.Del("ectm_headers")
+	ectmHeader.EncryptedHeaders = ""
+	protected := make(http.Header)
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		values := header.Values(name)
+		if len(values) == 0 || isECTMHeaderName(name) {
+			continue
+		}
+		protected[name] = values
+		header.Del(name)
+	}
+	if len(protected) == 0 {
+		return nil
+	}
+
+	envelope, err := json.Marshal(&headerEnvelope{Nonce: ectmHeader.Nonce, Header: protected})
+	if err != nil {
+		return err
+	}
+	encrypted, err := Encrypt(ectmHeader.Version, envelope, symmetricKey)
+	if err != nil {
+		return err
+	}
+	ectmHeader.EncryptedHeaders = base64.StdEncoding.EncodeToString(encrypted)
+	header.Set("ectm_headers", ectmHeader.EncryptedHeaders)
+	return nil
+}
+
+//CheckPlainHeaders rejects a request sending a header in names plain instead of in the encrypted ectm_headers header
+//a plain Content-Type is the type of the encrypted body, it is dropped instead, so only the encrypted one is used
+func CheckPlainHeaders(header http.Header, names []string) error {
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if name == "Content-Type" {
+			header.Del(name)
+			continue
+		}
+		if len(header.Values(name)) != 0 {
+			return fmt.Errorf("%w: %s", ErrPlainHeader, name)
+		}
+	}
+	return nil
+}
+
+//RestoreEncryptedHeaders decrypts the ectm_headers header and sets the headers in it, replacing plain ones
+//ectmHeader is the parsed header of the same message, messages without ectm_headers are left as they are
+func RestoreEncryptedHeaders(header http.Header, symmetricKey []byte, ectmHeader *ECTMHeader) error {
+	headersS, exist := header["Ectm_headers"]
+	if !exist || len(headersS) < 1 || headersS[0] == "" {
+		return nil
+	}
+	headersByte, err := base64.StdEncoding.DecodeString(headersS[0])
+	if err != nil {
+		return &DecryptError{Stage: DecryptStageHeaders, Err: err}
+	}
+	headersDecrypted, err := Decrypt(ectmHeader.Version, headersByte, symmetricKey)
+	if err != nil {
+		return &DecryptError{Stage: DecryptStageHeaders, Err: err}
+	}
+	var envelope headerEnvelope
+	err = json.Unmarshal(headersDecrypted, &envelope)
+	if err != nil {
+		return &DecryptError{Stage: DecryptStageHeaders, Err: err}
+	}
+	if !bytes.Equal(envelope.Nonce, ectmHeader.Nonce) {
+		return &DecryptError{Stage: DecryptStageHeaders, Err: errors.New("headers nonce mismatch")}
+	}
+
+	for name, values := range envelope.Header {
+		name = http.CanonicalHeaderKey(name)
+		if isECTMHeaderName(name) {
+			continue
+		}
+		header[name] = values
+	}
+	header.Del("ectm_headers")
+	return nil
+}
+
+//isECTMHeaderName tells if the canonical name is one of the ectm_* protocol headers, they are never in the envelope
+func isECTMHeaderName(name string) bool {
+	return strings.HasPrefix(name, "Ectm_")
+}
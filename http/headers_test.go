@@ -0,0 +1,38 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_EncryptedHeaders(t *testing.T) {
+	key := []byte("1234567890abcdef1234567890abcdef")
+	ectmHeader := &ECTMHeader{Version: ProtocolVersionGCM, Nonce: []byte("0123456789abcdef")}
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer abc")
+	header.Add("X-User-Id", "1")
+	header.Add("X-User-Id", "2")
+	header.Set("X-Plain", "plain")
+
+	err := SetEncryptedHeaders(header, []string{"authorization", "X-User-Id", "ectm_time"}, key, ectmHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Authorization") != "" || header.Get("X-User-Id") != "" || header.Get("X-Plain") != "plain" {
+		t.Fatal("headers not moved to envelope:", header)
+	}
+
+	//the envelope belongs to the message with this nonce
+	other := &ECTMHeader{Version: ProtocolVersionGCM, Nonce: []byte("fedcba9876543210")}
+	if err := RestoreEncryptedHeaders(header.Clone(), key, other); err == nil {
+		t.Fatal("envelope accepted for another nonce")
+	}
+
+	err = RestoreEncryptedHeaders(header, key, ectmHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Authorization") != "Bearer abc" || len(header.Values("X-User-Id")) != 2 || header.Get("ectm_headers") != "" {
+		t.Fatal("headers not restored:", header)
+	}
+}
@@ -1,8 +1,11 @@
 package http
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
@@ -14,7 +17,10 @@ import (
 type ECTResponse struct {
 	Rs            *http.Response
 	DecryptedBody []byte
-	Err           error
+	//set instead of DecryptedBody if the client was asked to stream the response, reading it decrypts the body
+	//the caller must close it
+	BodyReader io.ReadCloser
+	Err        error
 }
 
 func (ectR *ECTResponse) ToString() string {
@@ -27,10 +33,17 @@ func (ectR *ECTResponse) ToJson() *fj.FastJson {
 
 type ECTRequest struct {
 	Rq            *http.Request
+	Version       int
 	Token         []byte
+	Nonce         []byte
+	Signature     []byte
 	SymmetricKey  []byte
 	DecryptedBody []byte
-	Err           error
+	//set instead of DecryptedBody for a streamed body by HandleStream, reading it decrypts the body
+	BodyReader io.Reader
+	//the client can read a streamed response
+	AcceptStream bool
+	Err          error
 }
 
 func (ectRq *ECTRequest) GetToken() string {
@@ -51,55 +64,212 @@ func (ectRq *ECTRequest) ToJson() *fj.FastJson {
 const AllowRequestTimeGapSec = 180
 const AllowServerClientTimeGap = 30
 
+//protocol versions, sent in the plain "ectm_version" header
+//a message without the header is treated as ProtocolVersionCBC so old peers keep working
+const (
+	//legacy AES-CBC with the key as IV and no MAC
+	ProtocolVersionCBC = 1
+	//AES-256-GCM with a random nonce per message
+	ProtocolVersionGCM = 2
+)
+
+//ProtocolVersion is the version used when none is given
+const ProtocolVersion = ProtocolVersionGCM
+
+//NonceSize is the length of the random per request nonce in bytes
+const NonceSize = 16
+
+//ECTMHeader holds the decrypted values of the ectm_* headers
+type ECTMHeader struct {
+	Version  int
+	UnixTime int64
+	Nonce    []byte
+	Token    []byte
+	//response only, RequestDigest of the request being answered
+	Bind []byte
+	//response only, the body is an ErrorEnvelope, set from the plain ectm_error header
+	//it is bound to the body, see ResponseAdditionalData, so the header can not be added or removed
+	Envelope bool
+	//the ectm_headers header of the message, "" if none, the request signature covers it
+	EncryptedHeaders string
+}
+
+//ResponseAdditionalData is the GCM additional data of a response body or stream sent with ectmHeader
+//it binds the body to the request and to the error envelope marker
+func ResponseAdditionalData(ectmHeader *ECTMHeader) []byte {
+	if !ectmHeader.Envelope {
+		return ectmHeader.Bind
+	}
+	//Bind is empty or a fixed length digest, so the marker can not be confused with it
+	additionalData := make([]byte, 0, len(ectmHeader.Bind)+len(ErrorCodeEnvelope))
+	additionalData = append(additionalData, ectmHeader.Bind...)
+	return append(additionalData, ErrorCodeEnvelope...)
+}
+
+func Encrypt(version int, data []byte, symmetricKey []byte) ([]byte, error) {
+	switch version {
+	case ProtocolVersionCBC:
+		return utils.AESEncrypt(data, symmetricKey)
+	case ProtocolVersionGCM:
+		return utils.AESGCMEncrypt(data, symmetricKey)
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+}
+
+func Decrypt(version int, data []byte, symmetricKey []byte) ([]byte, error) {
+	switch version {
+	case ProtocolVersionCBC:
+		return utils.AESDecrypt(data, symmetricKey)
+	case ProtocolVersionGCM:
+		return utils.AESGCMDecrypt(data, symmetricKey)
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+}
+
+//GetProtocolVersion reads the plain ectm_version header, ProtocolVersionCBC if not exist
+func GetProtocolVersion(header http.Header) (int, error) {
+	versionS, exist := header["Ectm_version"]
+	if !exist || len(versionS) < 1 || versionS[0] == "" {
+		return ProtocolVersionCBC, nil
+	}
+	version, err := strconv.Atoi(versionS[0])
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedVersion, versionS[0])
+	}
+	if version != ProtocolVersionCBC && version != ProtocolVersionGCM {
+		return 0, ErrUnsupportedVersion
+	}
+	return version, nil
+}
+
 func EncryptAndSetECTMHeader(header http.Header, EcsKey []byte, symmetricKey []byte, token []byte) error {
+	return EncryptAndSetECTMHeaderWithVersion(header, EcsKey, symmetricKey, token, ProtocolVersion)
+}
+
+func EncryptAndSetECTMHeaderWithVersion(header http.Header, EcsKey []byte, symmetricKey []byte, token []byte, version int) error {
+	return SetECTMHeader(header, EcsKey, symmetricKey, &ECTMHeader{Version: version, Token: token})
+}
+
+//SetECTMHeader encrypts ectmHeader into header
+//UnixTime and Nonce are filled in when empty, so the caller can read back what was sent
+func SetECTMHeader(header http.Header, EcsKey []byte, symmetricKey []byte, ectmHeader *ECTMHeader) error {
+	version := ectmHeader.Version
+	if version == 0 {
+		version = ProtocolVersion
+		ectmHeader.Version = version
+	}
 	//set the ecs key only for request to server
 	if len(EcsKey) != 0 {
 		header.Set("ectm_key", base64.StdEncoding.EncodeToString(EcsKey))
 	}
+	//old peers do not know the version header, so only set it for newer versions
+	if version != ProtocolVersionCBC {
+		header.Set("ectm_version", strconv.Itoa(version))
+	}
 	//set the time
-	nowTimeStr := strconv.FormatInt(time.Now().Unix(), 10)
-	encrypted_time_byte, err := utils.AESEncrypt([]byte(nowTimeStr), symmetricKey)
+	if ectmHeader.UnixTime == 0 {
+		ectmHeader.UnixTime = time.Now().Unix()
+	}
+	nowTimeStr := strconv.FormatInt(ectmHeader.UnixTime, 10)
+	encrypted_time_byte, err := Encrypt(version, []byte(nowTimeStr), symmetricKey)
 	if err != nil {
 		return err
 	}
 	header.Set("ectm_time", base64.StdEncoding.EncodeToString(encrypted_time_byte))
+	//set nonce
+	if len(ectmHeader.Nonce) == 0 {
+		ectmHeader.Nonce = make([]byte, NonceSize)
+		if _, err := io.ReadFull(rand.Reader, ectmHeader.Nonce); err != nil {
+			return err
+		}
+	}
+	encrypted_nonce_byte, err := Encrypt(version, ectmHeader.Nonce, symmetricKey)
+	if err != nil {
+		return err
+	}
+	header.Set("ectm_nonce", base64.StdEncoding.EncodeToString(encrypted_nonce_byte))
 	//set token
-	if len(token) != 0 {
-		encrypted_token_byte, err := utils.AESEncrypt(token, symmetricKey)
+	if len(ectmHeader.Token) != 0 {
+		encrypted_token_byte, err := Encrypt(version, ectmHeader.Token, symmetricKey)
 		if err != nil {
 			return err
 		}
 		header.Set("ectm_token", base64.StdEncoding.EncodeToString(encrypted_token_byte))
 	}
+	//set bind
+	if len(ectmHeader.Bind) != 0 {
+		encrypted_bind_byte, err := Encrypt(version, ectmHeader.Bind, symmetricKey)
+		if err != nil {
+			return err
+		}
+		header.Set("ectm_bind", base64.StdEncoding.EncodeToString(encrypted_bind_byte))
+	}
 	header.Set("Cache-Control", "no-store")
 	return nil
 }
 
 //can be called from both server side and client side
 func DecryptECTMHeader(header http.Header, symmetricKey []byte) (token []byte, e error) {
+	ectmHeader, err := ParseECTMHeader(header, symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	return ectmHeader.Token, nil
+}
+
+//ParseECTMHeader checks and decrypts all ectm_* headers, the version is taken from the header itself
+func ParseECTMHeader(header http.Header, symmetricKey []byte) (*ECTMHeader, error) {
+
+	version, err := GetProtocolVersion(header)
+	if err != nil {
+		return nil, err
+	}
 
 	/////check time //////////
 	timeS, exist := header["Ectm_time"]
 	if !exist || len(timeS) < 1 || timeS[0] == "" {
-		return nil, errors.New("timestamp not exist")
+		return nil, ErrMissingTimestamp
 	}
 
 	timeByte, err := base64.StdEncoding.DecodeString(timeS[0])
 	if err != nil {
-		return nil, errors.New("timestamp base64 format error")
+		return nil, &DecryptError{Stage: DecryptStageTimestamp, Err: err}
 	}
 
-	timeDecrypted, err := utils.AESDecrypt(timeByte, symmetricKey)
+	timeDecrypted, err := Decrypt(version, timeByte, symmetricKey)
 	if err != nil {
-		return nil, errors.New("decrypt timestamp error")
+		return nil, &DecryptError{Stage: DecryptStageTimestamp, Err: err}
 	}
 	timeStamp, err := strconv.ParseInt(string(timeDecrypted), 10, 64)
 	if err != nil {
-		return nil, errors.New("timestamp ParseInt error")
+		return nil, &DecryptError{Stage: DecryptStageTimestamp, Err: err}
 	}
-	timeGap := time.Now().Unix() - timeStamp
-	if timeGap < -AllowRequestTimeGapSec || timeGap > AllowRequestTimeGapSec {
-		return nil, errors.New("time Gap error")
+	err = CheckTimeGap(timeStamp, AllowRequestTimeGapSec)
+	if err != nil {
+		return nil, err
+	}
+
+	//the marker is plain, it is checked when the body is decrypted
+	ectmHeader := &ECTMHeader{Version: version, UnixTime: timeStamp, Envelope: GetErrorCode(header) == ErrorCodeEnvelope,
+		EncryptedHeaders: header.Get("ectm_headers")}
+
+	///check nonce [optional, old peers do not send it]
+	nonceS, exist := header["Ectm_nonce"]
+	if exist && len(nonceS) > 0 && nonceS[0] != "" {
+		nonceByte, err := base64.StdEncoding.DecodeString(nonceS[0])
+		if err != nil {
+			return nil, &DecryptError{Stage: DecryptStageNonce, Err: err}
+		}
+		nonceDecrypted, err := Decrypt(version, nonceByte, symmetricKey)
+		if err != nil {
+			return nil, &DecryptError{Stage: DecryptStageNonce, Err: err}
+		}
+		if len(nonceDecrypted) != NonceSize {
+			return nil, &DecryptError{Stage: DecryptStageNonce, Err: errors.New("nonce length error")}
+		}
+		ectmHeader.Nonce = nonceDecrypted
 	}
 
 	///check token [optional]
@@ -107,31 +277,74 @@ func DecryptECTMHeader(header http.Header, symmetricKey []byte) (token []byte, e
 	if exist && len(tokenS) > 0 && tokenS[0] != "" {
 		tokenByte, err := base64.StdEncoding.DecodeString(tokenS[0])
 		if err != nil {
-			return nil, errors.New("token base64 format error")
+			return nil, &DecryptError{Stage: DecryptStageToken, Err: err}
 		}
-		tokenDecrypted, err := utils.AESDecrypt(tokenByte, symmetricKey)
+		tokenDecrypted, err := Decrypt(version, tokenByte, symmetricKey)
 		if err != nil {
-			return nil, errors.New("decrypt token error")
+			return nil, &DecryptError{Stage: DecryptStageToken, Err: err}
 		}
-		return tokenDecrypted, nil
+		ectmHeader.Token = tokenDecrypted
 	}
 
-	return nil, nil
+	///check bind [optional, responses only]
+	bindS, exist := header["Ectm_bind"]
+	if exist && len(bindS) > 0 && bindS[0] != "" {
+		bindByte, err := base64.StdEncoding.DecodeString(bindS[0])
+		if err != nil {
+			return nil, &DecryptError{Stage: DecryptStageBind, Err: err}
+		}
+		bindDecrypted, err := Decrypt(version, bindByte, symmetricKey)
+		if err != nil {
+			return nil, &DecryptError{Stage: DecryptStageBind, Err: err}
+		}
+		ectmHeader.Bind = bindDecrypted
+	}
+
+	return ectmHeader, nil
 }
 
 func EncryptBody(dataByte []byte, randKey []byte) (EncryptedBody []byte, err error) {
-	encryptedByte, err := utils.AESEncrypt(dataByte, randKey)
+	return EncryptBodyWithVersion(dataByte, randKey, ProtocolVersion)
+}
+
+func EncryptBodyWithVersion(dataByte []byte, randKey []byte, version int) (EncryptedBody []byte, err error) {
+	encryptedByte, err := Encrypt(version, dataByte, randKey)
 	if err != nil {
 		return nil, err
 	}
 	return encryptedByte, nil
 }
 
+//EncryptResponseBody encrypts a response body sent with ectmHeader
+//in ProtocolVersionGCM the body is bound to ectmHeader.Bind and Envelope, so it can not be sent under the header of another response
+func EncryptResponseBody(dataByte []byte, symmetricKey []byte, ectmHeader *ECTMHeader) ([]byte, error) {
+	if ectmHeader.Version != ProtocolVersionGCM {
+		return EncryptBodyWithVersion(dataByte, symmetricKey, ectmHeader.Version)
+	}
+	return utils.AESGCMEncryptWithAD(dataByte, symmetricKey, ResponseAdditionalData(ectmHeader))
+}
+
+//DecryptResponseBody decrypts a response body, ectmHeader is the checked header of the same response
+func DecryptResponseBody(body []byte, symmetricKey []byte, ectmHeader *ECTMHeader) ([]byte, error) {
+	if ectmHeader.Version != ProtocolVersionGCM {
+		return DecryptBodyWithVersion(body, symmetricKey, ectmHeader.Version)
+	}
+	//an envelope is never empty, an empty body would turn any response into an error
+	if len(body) == 0 && !ectmHeader.Envelope {
+		return nil, nil
+	}
+	return utils.AESGCMDecryptWithAD(body, symmetricKey, ResponseAdditionalData(ectmHeader))
+}
+
 func DecryptBody(body []byte, randKey []byte) ([]byte, error) {
+	return DecryptBodyWithVersion(body, randKey, ProtocolVersion)
+}
+
+func DecryptBodyWithVersion(body []byte, randKey []byte, version int) ([]byte, error) {
 	if len(body) == 0 {
 		return nil, nil
 	}
-	bufDecrypted, err := utils.AESDecrypt(body, randKey)
+	bufDecrypted, err := Decrypt(version, body, randKey)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,60 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//SupportedAlgorithms is advertised in PublicKeyInfo
+var SupportedAlgorithms = []string{
+	"ecies-secp256k1",
+	"ecdh-secp256k1-hkdf-sha256",
+	"aes-256-gcm",
+	"aes-cbc",
+	"hmac-sha256",
+}
+
+//PublicKeyInfo is the json document of the public key info endpoint
+type PublicKeyInfo struct {
+	UnixTime  int64
+	PublicKey string
+	//utils.PublicKeyId of PublicKey
+	KeyId           string
+	Algorithms      []string
+	ProtocolVersion int
+	//base64 public key of the server long-term identity key
+	IdentityKey string
+	//base64 signature by IdentityKey over PublicKeyInfoSignMessage
+	Signature string
+}
+
+//PublicKeyInfoSignMessage is the message signed by the identity key, it covers the identity key itself
+func PublicKeyInfoSignMessage(info *PublicKeyInfo) []byte {
+	return []byte(strings.Join([]string{
+		"ECTSM public key info",
+		strconv.FormatInt(info.UnixTime, 10),
+		info.PublicKey,
+		info.KeyId,
+		strings.Join(info.Algorithms, ","),
+		strconv.Itoa(info.ProtocolVersion),
+		info.IdentityKey,
+	}, "\n"))
+}
+
+//ErrIdentityKeyFormat means an identity key is not valid base64
+var ErrIdentityKeyFormat = errors.New("identity key format error")
+
+//IdentityFingerprint is the hex sha256 of the raw identity public key
+//it is what clients pin, see client.WithIdentityFingerprint
+func IdentityFingerprint(identityKeyBase64 string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(identityKeyBase64)
+	if err != nil || len(raw) == 0 {
+		return "", ErrIdentityKeyFormat
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+)
+
+//SetEncryptedQuery moves the query string of u into the encrypted ectm_query header,
+//so it does not show up in proxies and access logs
+//the request signature must be set before, it covers the plain query
+func SetEncryptedQuery(header http.Header, u *url.URL, symmetricKey []byte, version int) error {
+	if u.RawQuery == "" {
+		return nil
+	}
+	encrypted, err := Encrypt(version, []byte(u.RawQuery), symmetricKey)
+	if err != nil {
+		return err
+	}
+	header.Set("ectm_query", base64.StdEncoding.EncodeToString(encrypted))
+	u.RawQuery = ""
+	return nil
+}
+
+//RestoreEncryptedQuery decrypts the ectm_query header into u.RawQuery, replacing any plain query
+//requests without ectm_query are left as they are
+func RestoreEncryptedQuery(header http.Header, u *url.URL, symmetricKey []byte, version int) error {
+	queryS, exist := header["Ectm_query"]
+	if !exist || len(queryS) < 1 || queryS[0] == "" {
+		return nil
+	}
+	queryByte, err := base64.StdEncoding.DecodeString(queryS[0])
+	if err != nil {
+		return &DecryptError{Stage: DecryptStageQuery, Err: err}
+	}
+	queryDecrypted, err := Decrypt(version, queryByte, symmetricKey)
+	if err != nil {
+		return &DecryptError{Stage: DecryptStageQuery, Err: err}
+	}
+	u.RawQuery = string(queryDecrypted)
+	return nil
+}
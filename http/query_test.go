@@ -0,0 +1,35 @@
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func Test_EncryptedQuery(t *testing.T) {
+	key := []byte("1234567890abcdef1234567890abcdef")
+	u, _ := url.Parse("http://127.0.0.1:8080/test/get?user=1&q=secret")
+	header := make(http.Header)
+
+	err := SetEncryptedQuery(header, u, key, ProtocolVersionGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.RawQuery != "" || header.Get("ectm_query") == "" {
+		t.Fatal("query not moved to header")
+	}
+
+	//a plain query added on the way is replaced
+	u.RawQuery = "user=2"
+	err = RestoreEncryptedQuery(header, u, key, ProtocolVersionGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("user") != "1" || u.Query().Get("q") != "secret" {
+		t.Fatal("query not restored:", u.RawQuery)
+	}
+
+	if err := RestoreEncryptedQuery(header, u, []byte("abcdef1234567890abcdef1234567890"), ProtocolVersionGCM); err == nil {
+		t.Fatal("query decrypted with wrong key")
+	}
+}
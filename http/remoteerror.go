@@ -0,0 +1,54 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+//ErrorCodeEnvelope in the ectm_error header means the encrypted body is an ErrorEnvelope
+//the header is plain but bound to the body, see ResponseAdditionalData, only ProtocolVersionCBC does not authenticate it
+const ErrorCodeEnvelope = "envelope"
+
+const ErrorEnvelopeVersion = 1
+
+//ErrorCodeInvalidRequest is the envelope code of a request the server could decrypt the key of, but not verify,
+//see server.EncryptedErrorHandler
+const ErrorCodeInvalidRequest = "invalid_request"
+
+//ErrorEnvelope is the encrypted json body of an application error response
+type ErrorEnvelope struct {
+	Version int
+	//application error code, e.g. "not_found"
+	Code    string
+	Message string
+	Details interface{} `json:",omitempty"`
+	//id to find the request in the server logs
+	RequestId string `json:",omitempty"`
+}
+
+//RemoteError is an ErrorEnvelope received by the client
+type RemoteError struct {
+	StatusCode int
+	Version    int
+	Code       string
+	Message    string
+	//json of ErrorEnvelope.Details, nil if not set
+	Details   json.RawMessage
+	RequestId string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error,status code:%d,code:%s,message:%s", e.StatusCode, e.Code, e.Message)
+}
+
+//ParseRemoteError decodes the decrypted body of an envelope error response
+//a body that is not an envelope becomes the message
+func ParseRemoteError(statusCode int, body []byte) *RemoteError {
+	remoteError := &RemoteError{StatusCode: statusCode}
+	err := json.Unmarshal(body, remoteError)
+	if err != nil {
+		return &RemoteError{StatusCode: statusCode, Message: string(body)}
+	}
+	remoteError.StatusCode = statusCode
+	return remoteError
+}
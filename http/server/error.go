@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+//ECTSendBackErrorTo encrypts envelope for ectRq like ECTSendBackTo and marks the response as an error envelope,
+//the client returns it as *ecthttp.RemoteError, send it with an error status code
+func ECTSendBackErrorTo(ectRq *ecthttp.ECTRequest, header http.Header, envelope *ecthttp.ErrorEnvelope) ([]byte, error) {
+	if envelope.RequestId == "" && ectRq.Rq != nil {
+		envelope.RequestId = ectRq.Rq.Header.Get("X-Request-Id")
+	}
+	prepareErrorEnvelope(header, envelope)
+	return ECTSendBackTo(ectRq, header, envelope)
+}
+
+//SendError writes envelope as error response from a handler behind Middleware, which encrypts it
+func SendError(w http.ResponseWriter, statusCode int, envelope *ecthttp.ErrorEnvelope) error {
+	prepareErrorEnvelope(w.Header(), envelope)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	return json.NewEncoder(w).Encode(envelope)
+}
+
+//prepareErrorEnvelope sets the envelope version, the request id set by a request id middleware, and the ectm_error header
+func prepareErrorEnvelope(header http.Header, envelope *ecthttp.ErrorEnvelope) {
+	if envelope.Version == 0 {
+		envelope.Version = ecthttp.ErrorEnvelopeVersion
+	}
+	if envelope.RequestId == "" {
+		envelope.RequestId = header.Get("X-Request-Id")
+	}
+	header.Set("ectm_error", ecthttp.ErrorCodeEnvelope)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+//MultipartReader returns a reader of the decrypted parts of a multipart/form-data or multipart/mixed request
+//like r.MultipartReader(), ectRq is the result of Handle or HandleStream, a streamed body is decrypted part by part
+//the content type sent by EctHttpClient.ECTPostForm is restored from the encrypted ectm_headers header by Handle
+func MultipartReader(ectRq *ecthttp.ECTRequest) (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(ectRq.Rq.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "multipart/form-data" && mediaType != "multipart/mixed") {
+		return nil, http.ErrNotMultipart
+	}
+	boundary, ok := params["boundary"]
+	if !ok {
+		return nil, http.ErrMissingBoundary
+	}
+
+	var body io.Reader = ectRq.BodyReader
+	if body == nil {
+		body = bytes.NewReader(ectRq.DecryptedBody)
+	}
+	return multipart.NewReader(body, boundary), nil
+}
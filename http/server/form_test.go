@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/daqnext/ECTSM-go/http/client"
+)
+
+func Test_MultipartReader(t *testing.T) {
+	//answers "name:filename:content type:size" for each part
+	handler := func(hs *EctHttpServer) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			//the form content type is only sent encrypted
+			if strings.Contains(r.Header.Get("Content-Type"), "multipart") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ectRq := hs.HandleStream(r)
+			if ectRq.Err != nil {
+				hs.HandleError(w, ectRq)
+				return
+			}
+			mr, err := MultipartReader(ectRq)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var parts []string
+			for {
+				part, err := mr.NextPart()
+				if err != nil {
+					break
+				}
+				data, _ := ioutil.ReadAll(part)
+				parts = append(parts, fmt.Sprintf("%s:%s:%s:%d", part.FormName(), part.FileName(), part.Header.Get("Content-Type"), len(data)))
+			}
+			data, _ := ECTSendBackTo(ectRq, w.Header(), strings.Join(parts, ","))
+			w.Write(data)
+		})
+	}
+
+	file := bytes.Repeat([]byte("x"), 3<<20)
+	expected := "k:::1,doc:a.txt:text/plain:5,big:b.bin:application/octet-stream:3145728"
+
+	//streamed and sent as one body
+	for _, threshold := range []int{1024, 0} {
+		hs, hc := newTestPair(t, client.WithStreamThreshold(threshold))
+		ts := httptest.NewServer(handler(hs))
+		files := []client.FormFile{
+			{FieldName: "doc", FileName: "a.txt", ContentType: "text/plain", Reader: strings.NewReader("hello")},
+			{FieldName: "big", FileName: "b.bin", Reader: bytes.NewReader(file)},
+		}
+		result := hc.ECTPostForm(ts.URL, nil, url.Values{"k": {"v"}}, files)
+		ts.Close()
+		if result.Err != nil || result.ToString() != expected {
+			t.Fatal(threshold, result.Err, result.ToString())
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//ErrHandshakeRequest means the handshake request body is not a HandshakeRequest
+var ErrHandshakeRequest = errors.New("handshake request format error")
+
+//ServeHandshake is the handshake endpoint, mount it for POST
+//the client sends an ephemeral public key, the server answers with its own ephemeral public key
+//signed by the long-term private key, both sides derive the session key with HKDF
+//the ephemeral private key is dropped after the request, so a leaked long-term key can not decrypt recorded traffic
+//every handshake stores a session, HandshakeLimiter and MaxSessions bound how many
+func (hs *EctHttpServer) ServeHandshake(w http.ResponseWriter, r *http.Request) {
+	if hs.HandshakeLimiter != nil && !hs.HandshakeLimiter.Allow(ClientAddr(r)) {
+		sendTooManySessions(w)
+		return
+	}
+	handshakeResponse, err := hs.handshake(r)
+	if err == ErrTooManySessions {
+		sendTooManySessions(w)
+		return
+	}
+	if err != nil {
+		statusCode, body := ECTSendBackError(w.Header(), err)
+		w.WriteHeader(statusCode)
+		w.Write(body)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(handshakeResponse)
+}
+
+func (hs *EctHttpServer) handshake(r *http.Request) (*ecthttp.HandshakeResponse, error) {
+	var handshakeRequest ecthttp.HandshakeRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&handshakeRequest)
+	if err != nil {
+		return nil, ErrHandshakeRequest
+	}
+
+	nowTime := time.Now().Unix()
+	err = ecthttp.CheckTimeGap(handshakeRequest.UnixTime, ecthttp.AllowRequestTimeGapSec)
+	if err != nil {
+		return nil, err
+	}
+
+	signKey := hs.Keyring.Current()
+	if handshakeRequest.KeyId != "" {
+		var active bool
+		signKey, active = hs.Keyring.Get(handshakeRequest.KeyId)
+		if !active {
+			return nil, ecthttp.ErrUnknownKey
+		}
+	}
+
+	clientPublicKey, err := utils.StrBase64ToPublicKey(handshakeRequest.ClientPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralKey, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := utils.ECDHSharedSecret(ephemeralKey, clientPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPublicKey := utils.PublicKeyToString(&ephemeralKey.PublicKey)
+	symmetricKey, err := ecthttp.DeriveSessionKey(sharedSecret, handshakeRequest.ClientPublicKey, serverPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionId, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := utils.ECCSign(signKey.PrivateKey, ecthttp.HandshakeSignMessage(handshakeRequest.ClientPublicKey, serverPublicKey, sessionId, nowTime))
+	if err != nil {
+		return nil, err
+	}
+
+	if !hs.sessions.add(hs.MaxSessions, hs.SessionTTLSec) {
+		return nil, ErrTooManySessions
+	}
+	err = hs.KeyStore.Set(sessionCacheKey(sessionId), symmetricKey, hs.SessionTTLSec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecthttp.HandshakeResponse{
+		UnixTime:        nowTime,
+		ServerPublicKey: serverPublicKey,
+		SessionId:       sessionId,
+		Signature:       base64.StdEncoding.EncodeToString(sig),
+	}, nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//KeyringEntry is one private key of a Keyring
+type KeyringEntry struct {
+	KeyId      string
+	PrivateKey *ecdsa.PrivateKey
+	//zero for the current key, a retiring key is accepted until RetireAt
+	RetireAt time.Time
+}
+
+func (ke *KeyringEntry) active(now time.Time) bool {
+	return ke.RetireAt.IsZero() || now.Before(ke.RetireAt)
+}
+
+//Keyring holds the current private key, advertised on the info endpoint,
+//and the retiring keys still accepted for decryption
+//it is safe for concurrent use, keys can be rotated while serving
+type Keyring struct {
+	lock     sync.RWMutex
+	current  *KeyringEntry
+	retiring []*KeyringEntry
+}
+
+func NewKeyring(privateKey *ecdsa.PrivateKey) *Keyring {
+	return &Keyring{
+		current: &KeyringEntry{KeyId: utils.PublicKeyId(&privateKey.PublicKey), PrivateKey: privateKey},
+	}
+}
+
+//Current returns the key new clients encrypt to
+func (kr *Keyring) Current() *KeyringEntry {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return kr.current
+}
+
+//Get returns the current or a not yet retired key by id
+func (kr *Keyring) Get(keyId string) (*KeyringEntry, bool) {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	if kr.current.KeyId == keyId {
+		return kr.current, true
+	}
+	now := time.Now()
+	for _, entry := range kr.retiring {
+		if entry.KeyId == keyId && entry.active(now) {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+//Active returns the current key followed by the not yet retired keys
+func (kr *Keyring) Active() []*KeyringEntry {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	now := time.Now()
+	entries := []*KeyringEntry{kr.current}
+	for _, entry := range kr.retiring {
+		if entry.active(now) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+//Rotate makes privateKey the current key, the previous one is accepted for retireAfter more
+func (kr *Keyring) Rotate(privateKey *ecdsa.PrivateKey, retireAfter time.Duration) {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	now := time.Now()
+	previous := *kr.current
+	previous.RetireAt = now.Add(retireAfter)
+	kr.current = &KeyringEntry{KeyId: utils.PublicKeyId(&privateKey.PublicKey), PrivateKey: privateKey}
+	kr.retiring = kr.purge(now)
+	if previous.KeyId != kr.current.KeyId {
+		kr.retiring = append(kr.retiring, &previous)
+	}
+}
+
+//ErrRetireTimePassed means AddRetiring got a retire time that is not in the future
+var ErrRetireTimePassed = errors.New("retire time passed")
+
+//ErrCurrentKey means AddRetiring got the current key of the keyring
+var ErrCurrentKey = errors.New("key is the current key")
+
+//AddRetiring adds a key accepted until retireAt, e.g. the previous key after a restart
+func (kr *Keyring) AddRetiring(privateKey *ecdsa.PrivateKey, retireAt time.Time) error {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	now := time.Now()
+	if !retireAt.After(now) {
+		return ErrRetireTimePassed
+	}
+	entry := &KeyringEntry{KeyId: utils.PublicKeyId(&privateKey.PublicKey), PrivateKey: privateKey, RetireAt: retireAt}
+	if entry.KeyId == kr.current.KeyId {
+		return ErrCurrentKey
+	}
+	kr.retiring = append(kr.purge(now), entry)
+	return nil
+}
+
+//purge drops the retired keys and the current one, kr.lock must be held
+func (kr *Keyring) purge(now time.Time) []*KeyringEntry {
+	entries := kr.retiring[:0]
+	for _, entry := range kr.retiring {
+		if entry.active(now) && entry.KeyId != kr.current.KeyId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
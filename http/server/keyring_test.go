@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+func Test_KeyringRotate(t *testing.T) {
+	first, _ := utils.GenSecp256k1KeyPair()
+	second, _ := utils.GenSecp256k1KeyPair()
+	kr := NewKeyring(first)
+	firstId := kr.Current().KeyId
+
+	kr.Rotate(second, time.Hour)
+	if kr.Current().KeyId != utils.PublicKeyId(&second.PublicKey) {
+		t.Fatal("current key not rotated")
+	}
+	if _, active := kr.Get(firstId); !active {
+		t.Fatal("retiring key not accepted")
+	}
+	if len(kr.Active()) != 2 {
+		t.Fatal("active keys error")
+	}
+
+	kr.Rotate(first, -time.Second)
+	if _, active := kr.Get(utils.PublicKeyId(&second.PublicKey)); active {
+		t.Fatal("retired key accepted")
+	}
+	if len(kr.Active()) != 1 {
+		t.Fatal("active keys error")
+	}
+}
+
+func Test_KeyringAddRetiring(t *testing.T) {
+	first, _ := utils.GenSecp256k1KeyPair()
+	second, _ := utils.GenSecp256k1KeyPair()
+	kr := NewKeyring(first)
+
+	if err := kr.AddRetiring(first, time.Now().Add(time.Hour)); !errors.Is(err, ErrCurrentKey) {
+		t.Fatal("expected current key error:", err)
+	}
+	if err := kr.AddRetiring(second, time.Now().Add(-time.Second)); !errors.Is(err, ErrRetireTimePassed) {
+		t.Fatal("expected retire time error:", err)
+	}
+	if err := kr.AddRetiring(second, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, active := kr.Get(utils.PublicKeyId(&second.PublicKey)); !active {
+		t.Fatal("retiring key not accepted")
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"sync"
+
+	"github.com/daqnext/ECTSM-go/utils"
+	locallog "github.com/daqnext/LocalLog/log"
+	go_fast_cache "github.com/daqnext/go-fast-cache"
+)
+
+const DefaultKeyCacheTTLSec = 3600
+
+//ErrInvalidTTL means a ttl that is not positive, a store would keep the value forever or drop it at once
+var ErrInvalidTTL = errors.New("ttl must be positive")
+
+const keyStoreKeyInfo = "ECTSM key store aes-256-gcm"
+
+//KeyStore keeps the symmetric keys of ecs keys and sessions
+//share one between the instances behind a load balancer, so an ecs key is decrypted once
+//and a session works on every instance
+type KeyStore interface {
+	//Get returns the value of key, exist is false if it is missing or expired
+	Get(key string) (value []byte, exist bool, err error)
+	//Set stores value for ttlSec seconds, ErrInvalidTTL if ttlSec is not positive
+	Set(key string, value []byte, ttlSec int64) error
+	Delete(key string) error
+	//Touch makes key expire ttlSec seconds from now, exist is false if it is missing or expired
+	//ErrInvalidTTL if ttlSec is not positive
+	Touch(key string, ttlSec int64) (exist bool, err error)
+}
+
+//MemKeyStore is the in-process KeyStore used by default
+type MemKeyStore struct {
+	cache *go_fast_cache.LocalCache
+	//serializes the read and write of Touch with Set and Delete, so a deleted key is not set again
+	lock sync.Mutex
+}
+
+func NewMemKeyStore(llog *locallog.LocalLog) *MemKeyStore {
+	return &MemKeyStore{cache: go_fast_cache.New(llog)}
+}
+
+func (ks *MemKeyStore) Get(key string) ([]byte, bool, error) {
+	value, _, exist := ks.cache.Get(key)
+	if !exist {
+		return nil, false, nil
+	}
+	return value.([]byte), true, nil
+}
+
+func (ks *MemKeyStore) Set(key string, value []byte, ttlSec int64) error {
+	if ttlSec <= 0 {
+		return ErrInvalidTTL
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.cache.Set(key, value, ttlSec)
+	return nil
+}
+
+func (ks *MemKeyStore) Delete(key string) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.cache.Delete(key)
+	return nil
+}
+
+func (ks *MemKeyStore) Touch(key string, ttlSec int64) (bool, error) {
+	if ttlSec <= 0 {
+		return false, ErrInvalidTTL
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	value, _, exist := ks.cache.Get(key)
+	if !exist {
+		return false, nil
+	}
+	ks.cache.Set(key, value, ttlSec)
+	return true, nil
+}
+
+//sealedKeyStore encrypts the values of a KeyStore outside the process with a key derived from the identity key,
+//so reading the store does not give away the symmetric keys, every value is bound to its key name
+//a value that does not decrypt, e.g. after the identity key changed, is treated as missing
+type sealedKeyStore struct {
+	KeyStore
+	key []byte
+}
+
+func newSealedKeyStore(store KeyStore, identityKey *ecdsa.PrivateKey) (*sealedKeyStore, error) {
+	key, err := utils.DeriveKey(identityKey.D.Bytes(), nil, keyStoreKeyInfo, utils.SymmetricKeyLen256)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedKeyStore{KeyStore: store, key: key}, nil
+}
+
+func (ks *sealedKeyStore) Get(key string) ([]byte, bool, error) {
+	sealed, exist, err := ks.KeyStore.Get(key)
+	if err != nil || !exist {
+		return nil, false, err
+	}
+	value, err := utils.AESGCMDecryptWithAD(sealed, ks.key, []byte(key))
+	if err != nil {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+func (ks *sealedKeyStore) Set(key string, value []byte, ttlSec int64) error {
+	sealed, err := utils.AESGCMEncryptWithAD(value, ks.key, []byte(key))
+	if err != nil {
+		return err
+	}
+	return ks.KeyStore.Set(key, sealed, ttlSec)
+}
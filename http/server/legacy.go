@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+//legacyKeyLimit bounds the keys remembered for ECTSendBack, the oldest are dropped first
+const legacyKeyLimit = 100000
+
+//legacyKeyTTLSec is how long a key is remembered after its last ProtocolVersionCBC request
+const legacyKeyTTLSec = DefaultKeyCacheTTLSec
+
+type legacyKeyEntry struct {
+	hash     [sha256.Size]byte
+	expireAt int64
+}
+
+//legacyKeySet remembers the symmetric keys of recent ProtocolVersionCBC requests by their hash,
+//so the deprecated ECTSendBack, which does not see the request, answers old clients in the version they use
+type legacyKeySet struct {
+	lock  sync.Mutex
+	seen  map[[sha256.Size]byte]int64
+	queue []legacyKeyEntry
+}
+
+var legacyKeys = &legacyKeySet{seen: make(map[[sha256.Size]byte]int64)}
+
+func (ks *legacyKeySet) add(symmetricKey []byte) {
+	hash := sha256.Sum256(symmetricKey)
+	now := time.Now().Unix()
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.purge(now)
+	if len(ks.queue) >= legacyKeyLimit {
+		if entry := ks.queue[0]; ks.seen[entry.hash] == entry.expireAt {
+			delete(ks.seen, entry.hash)
+		}
+		ks.queue = ks.queue[1:]
+	}
+	expireAt := now + legacyKeyTTLSec
+	ks.seen[hash] = expireAt
+	ks.queue = append(ks.queue, legacyKeyEntry{hash: hash, expireAt: expireAt})
+}
+
+func (ks *legacyKeySet) has(symmetricKey []byte) bool {
+	hash := sha256.Sum256(symmetricKey)
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	expireAt, exist := ks.seen[hash]
+	return exist && expireAt > time.Now().Unix()
+}
+
+//purge drops expired entries, a key seen again has a later entry in the queue, so only its last entry removes it
+func (ks *legacyKeySet) purge(now int64) {
+	i := 0
+	for ; i < len(ks.queue) && ks.queue[i].expireAt <= now; i++ {
+		entry := ks.queue[i]
+		if ks.seen[entry.hash] == entry.expireAt {
+			delete(ks.seen, entry.hash)
+		}
+	}
+	ks.queue = ks.queue[i:]
+}
+
+//legacyVersion is the version ECTSendBack answers in for symmetricKey
+func legacyVersion(symmetricKey []byte) int {
+	if legacyKeys.has(symmetricKey) {
+		return ecthttp.ProtocolVersionCBC
+	}
+	return ecthttp.ProtocolVersion
+}
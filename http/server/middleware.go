@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+type contextKey int
+
+const ectRequestContextKey contextKey = 0
+
+//RequestFromContext returns the decrypted request put in the context by Middleware, nil if none
+func RequestFromContext(ctx context.Context) *ecthttp.ECTRequest {
+	ectRq, _ := ctx.Value(ectRequestContextKey).(*ecthttp.ECTRequest)
+	return ectRq
+}
+
+//TokenFromContext returns the decrypted ectm_token of the request
+func TokenFromContext(ctx context.Context) []byte {
+	ectRq := RequestFromContext(ctx)
+	if ectRq == nil {
+		return nil
+	}
+	return ectRq.Token
+}
+
+//SymmetricKeyFromContext returns the symmetric key of the request
+func SymmetricKeyFromContext(ctx context.Context) []byte {
+	ectRq := RequestFromContext(ctx)
+	if ectRq == nil {
+		return nil
+	}
+	return ectRq.SymmetricKey
+}
+
+//ErrorHandler writes the response when Middleware can not decrypt a request
+type ErrorHandler func(w http.ResponseWriter, ectRq *ecthttp.ECTRequest)
+
+//PlainErrorHandler answers with ECTSendBackError, it is the default
+func PlainErrorHandler(w http.ResponseWriter, ectRq *ecthttp.ECTRequest) {
+	statusCode, body := ECTSendBackError(w.Header(), ectRq.Err)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+//EncryptedErrorHandler answers with an encrypted error envelope when the symmetric key and ectm_* headers of the request
+//can be read, e.g. for a signature error, and falls back to PlainErrorHandler otherwise
+//the client gets the envelope as *ecthttp.RemoteError with Code ecthttp.ErrorCodeInvalidRequest
+func EncryptedErrorHandler(w http.ResponseWriter, ectRq *ecthttp.ECTRequest) {
+	if ectRq.SymmetricKey == nil || ectRq.Rq == nil {
+		PlainErrorHandler(w, ectRq)
+		return
+	}
+	//the request was not verified, the response is bound to the nonce and signature it came with,
+	//so the client can tell the envelope answers its request
+	requestHeader, err := ecthttp.ParseECTMHeader(ectRq.Rq.Header, ectRq.SymmetricKey)
+	if err != nil {
+		PlainErrorHandler(w, ectRq)
+		return
+	}
+	sig, _ := ecthttp.GetRequestSignature(ectRq.Rq.Header)
+	ectmHeader := &ecthttp.ECTMHeader{Version: requestHeader.Version}
+	if len(requestHeader.Nonce) != 0 {
+		ectmHeader.Bind = ecthttp.RequestDigest(requestHeader.Nonce, sig)
+	}
+
+	statusCode, _ := ECTSendBackError(make(http.Header), ectRq.Err)
+	envelope := &ecthttp.ErrorEnvelope{Code: ecthttp.ErrorCodeInvalidRequest, Message: ectRq.Err.Error()}
+	header := w.Header()
+	prepareErrorEnvelope(header, envelope)
+	sendData, err := ectSendBack(header, ectRq.SymmetricKey, ectmHeader, envelope, nil)
+	if err != nil {
+		header.Del("ectm_error")
+		PlainErrorHandler(w, ectRq)
+		return
+	}
+	header.Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(statusCode)
+	w.Write(sendData)
+}
+
+//Middleware decrypts the request before next runs and encrypts whatever next writes
+//next reads the plain body from r.Body, and the token and key with TokenFromContext and SymmetricKeyFromContext
+//requests that fail to decrypt are answered by ErrorHandler and do not reach next
+func (hs *EctHttpServer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ectRq := hs.HandleStream(r)
+		if ectRq.Err != nil {
+			hs.HandleError(w, ectRq)
+			return
+		}
+
+		r = WithECTRequest(r, ectRq)
+		rw := hs.NewResponseWriter(w, ectRq)
+		next.ServeHTTP(rw, r)
+		rw.Close()
+	})
+}
+
+//HandleError answers a request that failed to decrypt with hs.ErrorHandler, or PlainErrorHandler if not set
+func (hs *EctHttpServer) HandleError(w http.ResponseWriter, ectRq *ecthttp.ECTRequest) {
+	errorHandler := hs.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = PlainErrorHandler
+	}
+	errorHandler(w, ectRq)
+}
+
+//WithECTRequest returns a copy of r whose body is the decrypted body and whose context holds ectRq
+func WithECTRequest(r *http.Request, ectRq *ecthttp.ECTRequest) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), ectRequestContextKey, ectRq))
+	if ectRq.BodyReader != nil {
+		//streamed, the length is not known
+		r.Body = ioutil.NopCloser(ectRq.BodyReader)
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
+	} else {
+		r.Body = ioutil.NopCloser(bytes.NewReader(ectRq.DecryptedBody))
+		r.ContentLength = int64(len(ectRq.DecryptedBody))
+		r.Header.Set("Content-Length", strconv.Itoa(len(ectRq.DecryptedBody)))
+	}
+	ectRq.Rq = r
+	return r
+}
+
+var errDetached = errors.New("response is written by another writer")
+
+//ResponseWriter buffers what a handler writes and sends it encrypted with ECTSendBackTo on Close
+//once the body is larger than StreamThreshold, or on Flush, it switches to a streamed response
+//if the client accepts streams
+type ResponseWriter struct {
+	//headers sent in the encrypted ectm_headers header
+	EncryptedHeaders []string
+	//0 never streams
+	StreamThreshold int
+
+	w          http.ResponseWriter
+	ectRq      *ecthttp.ECTRequest
+	statusCode int
+	buf        bytes.Buffer
+	stream     *ecthttp.EncryptWriter
+	closed     bool
+	//the handler writes the response itself, see detach
+	detached bool
+}
+
+func NewResponseWriter(w http.ResponseWriter, ectRq *ecthttp.ECTRequest) *ResponseWriter {
+	return &ResponseWriter{w: w, ectRq: ectRq}
+}
+
+//NewResponseWriter returns a ResponseWriter with the response settings of hs
+func (hs *EctHttpServer) NewResponseWriter(w http.ResponseWriter, ectRq *ecthttp.ECTRequest) *ResponseWriter {
+	rw := NewResponseWriter(w, ectRq)
+	rw.EncryptedHeaders = hs.EncryptedResponseHeaders
+	rw.StreamThreshold = hs.StreamThreshold
+	return rw
+}
+
+func (rw *ResponseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *ResponseWriter) WriteHeader(statusCode int) {
+	if rw.statusCode == 0 {
+		rw.statusCode = statusCode
+	}
+}
+
+func (rw *ResponseWriter) Write(b []byte) (int, error) {
+	if rw.detached {
+		return 0, errDetached
+	}
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+	if rw.stream != nil {
+		return rw.stream.Write(b)
+	}
+	n, err := rw.buf.Write(b)
+	if rw.StreamThreshold > 0 && rw.buf.Len() > rw.StreamThreshold && rw.canStream() {
+		err = rw.startStream()
+	}
+	return n, err
+}
+
+//Flush sends what was written so far, the response is streamed from then on
+//it does nothing if the client does not accept streams
+func (rw *ResponseWriter) Flush() {
+	if rw.closed || !rw.canStream() {
+		return
+	}
+	if rw.stream == nil {
+		if rw.statusCode == 0 {
+			rw.statusCode = http.StatusOK
+		}
+		if rw.startStream() != nil {
+			return
+		}
+	}
+	if rw.stream.Flush() != nil {
+		return
+	}
+	if flusher, ok := rw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//detach returns the underlying writer for a handler that writes the response itself, Close then does nothing
+//and later writes to rw fail, they would not be encrypted
+func (rw *ResponseWriter) detach() http.ResponseWriter {
+	rw.closed = true
+	rw.detached = true
+	return rw.w
+}
+
+func (rw *ResponseWriter) canStream() bool {
+	return rw.ectRq.AcceptStream && rw.ectRq.Version != ecthttp.ProtocolVersionCBC
+}
+
+//startStream sends the header and the buffered body as the start of a streamed response
+func (rw *ResponseWriter) startStream() error {
+	streamId, err := ecthttp.NewStreamId()
+	if err != nil {
+		return err
+	}
+	header := rw.w.Header()
+	header.Del("Content-Length")
+	ectmHeader := responseECTMHeader(rw.ectRq)
+	err = setResponseHeader(header, rw.ectRq.SymmetricKey, ectmHeader, rw.EncryptedHeaders)
+	if err != nil {
+		return err
+	}
+	ecthttp.SetStreamHeader(header, streamId)
+	header.Set("Content-Type", "application/octet-stream")
+
+	//the chunks are bound to the request like the response header
+	stream, err := ecthttp.NewEncryptWriter(rw.w, rw.ectRq.SymmetricKey, streamId, ecthttp.ResponseAdditionalData(ectmHeader))
+	if err != nil {
+		return err
+	}
+	rw.w.WriteHeader(rw.statusCode)
+	rw.stream = stream
+	_, err = stream.Write(rw.buf.Bytes())
+	rw.buf.Reset()
+	return err
+}
+
+//Close encrypts the buffered body and writes the response, only the first call has effect
+func (rw *ResponseWriter) Close() error {
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+	if rw.stream != nil {
+		return rw.stream.Close()
+	}
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+
+	var data interface{}
+	if rw.buf.Len() > 0 {
+		data = rw.buf.Bytes()
+	}
+	header := rw.w.Header()
+	header.Del("Content-Length")
+	sendData, err := ECTSendBackTo(rw.ectRq, header, data, rw.EncryptedHeaders...)
+	if err != nil {
+		http.Error(rw.w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	header.Set("Content-Type", "application/octet-stream")
+	rw.w.WriteHeader(rw.statusCode)
+	_, err = rw.w.Write(sendData)
+	return err
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+func Test_Middleware(t *testing.T) {
+	hs, hc := newTestPair(t)
+	hs.EncryptedResponseHeaders = []string{"X-Secret"}
+	ts := httptest.NewServer(hs.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Secret", "secret")
+		w.WriteHeader(http.StatusCreated)
+		//buffered until the handler returns
+		w.Write([]byte(string(TokenFromContext(r.Context())) + ":"))
+		w.Write(body)
+	})))
+	defer ts.Close()
+
+	result := hc.ECTPost(ts.URL, []byte("token"), "body")
+	if result.Err != nil || result.ToString() != "token:body" {
+		t.Fatal(result.Err, result.ToString())
+	}
+	if result.Rs.StatusCode != http.StatusCreated || result.Rs.Header.Get("X-Secret") != "secret" {
+		t.Fatal("status or header lost", result.Rs.StatusCode, result.Rs.Header)
+	}
+
+	//not encrypted requests do not reach the handler
+	rs, err := http.Post(ts.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	if rs.StatusCode != http.StatusBadRequest {
+		t.Fatal("plain request accepted", rs.StatusCode)
+	}
+}
+
+func Test_ResponseWriterStream(t *testing.T) {
+	hs, hc := newTestPair(t)
+	hs.StreamThreshold = 1000
+	large := bytes.Repeat([]byte("0123456789abcdef"), 3*ecthttp.StreamChunkSize/16)
+	ts := httptest.NewServer(hs.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("small"))
+		case "/large":
+			for i := 0; i < len(large); i += 4096 {
+				w.Write(large[i : i+4096])
+			}
+		case "/flush":
+			w.Write([]byte("flushed"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(" and more"))
+		}
+	})))
+	defer ts.Close()
+
+	cases := []struct {
+		path     string
+		body     []byte
+		streamed bool
+	}{
+		{"/small", []byte("small"), false},
+		{"/large", large, true},
+		{"/flush", []byte("flushed and more"), true},
+	}
+	for _, c := range cases {
+		result := hc.ECTGet(ts.URL+c.path, nil)
+		if result.Err != nil || !bytes.Equal(result.DecryptedBody, c.body) {
+			t.Fatal(c.path, result.Err, len(result.DecryptedBody))
+		}
+		if streamed := result.Rs.Header.Get("ectm_stream") != ""; streamed != c.streamed {
+			t.Fatal(c.path, "streamed:", streamed)
+		}
+	}
+
+	//clients of the legacy protocol can not read streams
+	hc.ProtocolVersion = ecthttp.ProtocolVersionCBC
+	result := hc.ECTGet(ts.URL+"/large", nil)
+	if result.Err != nil || !bytes.Equal(result.DecryptedBody, large) || result.Rs.Header.Get("ectm_stream") != "" {
+		t.Fatal(result.Err, len(result.DecryptedBody))
+	}
+}
+
+func Test_ResponseWriterDetach(t *testing.T) {
+	ectRq := &ecthttp.ECTRequest{Version: ecthttp.ProtocolVersionGCM, SymmetricKey: bytes.Repeat([]byte("k"), 32)}
+	recorder := httptest.NewRecorder()
+	rw := NewResponseWriter(recorder, ectRq)
+	w := rw.detach()
+	w.Write([]byte("plain"))
+
+	if _, err := rw.Write([]byte("lost")); err != errDetached {
+		t.Fatal("write after detach accepted:", err)
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Body.String() != "plain" || recorder.Header().Get("ectm_time") != "" {
+		t.Fatal("detached writer wrote", recorder.Body.String())
+	}
+}
+
+func Test_EncryptedErrorHandler(t *testing.T) {
+	hs, hc := newTestPair(t)
+	hs.ErrorHandler = EncryptedErrorHandler
+	handler := hs.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not reached"))
+	}))
+	//the method is changed after signing, so the signature check fails
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Method = "PUT"
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	//ECTDo and Transport give the same error
+	result := hc.ECTPost(ts.URL, nil, "body")
+	var remoteError *ecthttp.RemoteError
+	if !errors.As(result.Err, &remoteError) {
+		t.Fatal("not an envelope:", result.Err)
+	}
+	if remoteError.StatusCode != http.StatusBadRequest || remoteError.Code != ecthttp.ErrorCodeInvalidRequest || !strings.Contains(remoteError.Message, "signature") {
+		t.Fatal(remoteError)
+	}
+
+	rs, err := (&http.Client{Transport: hc.Transport()}).Post(ts.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+	body, _ := ioutil.ReadAll(rs.Body)
+	transportError := ecthttp.ParseRemoteError(rs.StatusCode, body)
+	if rs.StatusCode != http.StatusBadRequest || transportError.Code != remoteError.Code || transportError.Message != remoteError.Message {
+		t.Fatal(rs.StatusCode, string(body))
+	}
+}
+
+//tamperWriter changes the header when the response is sent, like a proxy between client and server
+type tamperWriter struct {
+	http.ResponseWriter
+	tamper func(header http.Header)
+}
+
+func (tw *tamperWriter) WriteHeader(statusCode int) {
+	tw.tamper(tw.Header())
+	tw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func Test_EnvelopeMarker(t *testing.T) {
+	hs, hc := newTestPair(t)
+	handler := hs.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			SendError(w, http.StatusNotFound, &ecthttp.ErrorEnvelope{Code: "not_found", Message: "no such item"})
+			return
+		}
+		w.Write([]byte(`{"Code":"forged"}`))
+	}))
+	var tamper func(header http.Header)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&tamperWriter{ResponseWriter: w, tamper: tamper}, r)
+	}))
+	defer ts.Close()
+
+	tamper = func(header http.Header) {}
+	result := hc.ECTGet(ts.URL+"/error", nil)
+	var remoteError *ecthttp.RemoteError
+	if !errors.As(result.Err, &remoteError) || remoteError.Code != "not_found" {
+		t.Fatal("expected remote error:", result.Err)
+	}
+	result = hc.ECTGet(ts.URL+"/ok", nil)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	//a stripped marker does not turn the error into a success
+	tamper = func(header http.Header) { header.Del("ectm_error") }
+	result = hc.ECTGet(ts.URL+"/error", nil)
+	var statusError *ecthttp.StatusError
+	if !errors.As(result.Err, &statusError) || statusError.StatusCode != http.StatusNotFound {
+		t.Fatal("expected status error:", result.Err)
+	}
+	//an added marker does not turn the success into an error
+	tamper = func(header http.Header) { header.Set("ectm_error", ecthttp.ErrorCodeEnvelope) }
+	result = hc.ECTGet(ts.URL+"/ok", nil)
+	if !errors.Is(result.Err, ecthttp.ErrDecrypt) {
+		t.Fatal("expected decrypt error:", result.Err)
+	}
+	rs, err := (&http.Client{Transport: hc.Transport()}).Get(ts.URL + "/ok")
+	if err == nil {
+		rs.Body.Close()
+	}
+	if !errors.Is(err, ecthttp.ErrDecrypt) {
+		t.Fatal("expected decrypt error:", err)
+	}
+}
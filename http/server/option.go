@@ -0,0 +1,111 @@
+package server
+
+import "crypto/ecdsa"
+
+//Option configures an EctHttpServer in New
+type Option func(hs *EctHttpServer)
+
+//WithReplayProtection rejects requests whose nonce was already seen,
+//remembering at most maxEntries nonces in memory
+func WithReplayProtection(maxEntries int) Option {
+	return func(hs *EctHttpServer) {
+		hs.NonceStore = NewMemNonceStore(maxEntries)
+	}
+}
+
+//WithNonceStore enables replay protection with a custom store
+func WithNonceStore(store NonceStore) Option {
+	return func(hs *EctHttpServer) {
+		hs.NonceStore = store
+	}
+}
+
+//WithKeyStore keeps the keys of ecs keys and sessions in store instead of in memory,
+//e.g. a RedisKeyStore shared by the instances behind a load balancer
+//the keys are stored AES-GCM encrypted with a key derived from the identity key, so the instances sharing
+//the store need the same identity key, the store still sees the ecs keys and session ids it is keyed by
+func WithKeyStore(store KeyStore) Option {
+	return func(hs *EctHttpServer) {
+		hs.KeyStore = store
+	}
+}
+
+//WithKeyCacheTTL sets how long the key of an ecs key is kept, DefaultKeyCacheTTLSec by default
+func WithKeyCacheTTL(ttlSec int64) Option {
+	return func(hs *EctHttpServer) {
+		hs.KeyCacheTTLSec = ttlSec
+	}
+}
+
+//WithSlidingSessions makes sessions expire SessionTTLSec after their last use instead of after their creation
+func WithSlidingSessions() Option {
+	return func(hs *EctHttpServer) {
+		hs.SlidingSessions = true
+	}
+}
+
+//WithSessionTTL sets how long handshake and ecs sessions live, DefaultSessionTTLSec by default
+func WithSessionTTL(ttlSec int64) Option {
+	return func(hs *EctHttpServer) {
+		hs.SessionTTLSec = ttlSec
+	}
+}
+
+//WithSessionRateLimit lets each client start at most rate handshakes and rate ecs sessions per second, with bursts of burst,
+//DefaultSessionRate and DefaultSessionBurst by default, a rate <= 0 does not limit
+func WithSessionRateLimit(rate float64, burst int) Option {
+	return func(hs *EctHttpServer) {
+		if rate <= 0 {
+			hs.HandshakeLimiter, hs.SessionLimiter = nil, nil
+			return
+		}
+		hs.HandshakeLimiter, hs.SessionLimiter = NewClientRateLimiter(rate, burst), NewClientRateLimiter(rate, burst)
+	}
+}
+
+//WithMaxSessions bounds the sessions ServeHandshake and ServeSession keep per instance,
+//DefaultMaxSessions by default, 0 does not bound
+func WithMaxSessions(max int) Option {
+	return func(hs *EctHttpServer) {
+		hs.MaxSessions = max
+	}
+}
+
+//WithIdentityKey sets the long-term key signing the public key info,
+//so clients can pin it while the encryption key changes
+func WithIdentityKey(identityKey *ecdsa.PrivateKey) Option {
+	return func(hs *EctHttpServer) {
+		hs.IdentityKey = identityKey
+	}
+}
+
+//WithErrorHandler sets how Middleware answers requests it can not decrypt,
+//PlainErrorHandler by default or EncryptedErrorHandler
+func WithErrorHandler(errorHandler ErrorHandler) Option {
+	return func(hs *EctHttpServer) {
+		hs.ErrorHandler = errorHandler
+	}
+}
+
+//WithEncryptedRequestHeaders rejects requests sending the headers with these names plain,
+//clients must send them with client.WithEncryptedHeaders, a plain Content-Type is dropped instead
+func WithEncryptedRequestHeaders(names ...string) Option {
+	return func(hs *EctHttpServer) {
+		hs.EncryptedRequestHeaders = append(hs.EncryptedRequestHeaders, names...)
+	}
+}
+
+//WithEncryptedResponseHeaders makes Middleware send the response headers with these names
+//in the encrypted ectm_headers header
+func WithEncryptedResponseHeaders(names ...string) Option {
+	return func(hs *EctHttpServer) {
+		hs.EncryptedResponseHeaders = append(hs.EncryptedResponseHeaders, names...)
+	}
+}
+
+//WithStreamThreshold sets the response size above which Middleware streams, 0 never streams
+func WithStreamThreshold(threshold int) Option {
+	return func(hs *EctHttpServer) {
+		hs.StreamThreshold = threshold
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//PublicKeyInfo returns the signed info document of the current key
+func (hs *EctHttpServer) PublicKeyInfo() (*ecthttp.PublicKeyInfo, error) {
+	current := hs.Keyring.Current()
+	info := &ecthttp.PublicKeyInfo{
+		UnixTime:        time.Now().Unix(),
+		PublicKey:       utils.PublicKeyToString(&current.PrivateKey.PublicKey),
+		KeyId:           current.KeyId,
+		Algorithms:      ecthttp.SupportedAlgorithms,
+		ProtocolVersion: ecthttp.ProtocolVersion,
+	}
+	err := hs.SignPublicKeyInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+//ServePublicKeyInfo is the public key info endpoint the client PublicKeyUrl points to, mount it for GET
+func (hs *EctHttpServer) ServePublicKeyInfo(w http.ResponseWriter, r *http.Request) {
+	info, err := hs.PublicKeyInfo()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+}
+
+//SignPublicKeyInfo sets IdentityKey and Signature of info with the server identity key
+func (hs *EctHttpServer) SignPublicKeyInfo(info *ecthttp.PublicKeyInfo) error {
+	identityKey := hs.IdentityKey
+	info.IdentityKey = utils.PublicKeyToString(&identityKey.PublicKey)
+	sig, err := utils.ECCSign(identityKey, ecthttp.PublicKeyInfoSignMessage(info))
+	if err != nil {
+		return err
+	}
+	info.Signature = base64.StdEncoding.EncodeToString(sig)
+	return nil
+}
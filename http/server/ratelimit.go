@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//sessions per second and burst each client gets from the default HandshakeLimiter and SessionLimiter
+const DefaultSessionRate = 1
+const DefaultSessionBurst = 10
+
+//DefaultMaxSessions bounds the sessions ServeHandshake and ServeSession keep in the KeyStore per instance
+const DefaultMaxSessions = 100000
+
+//maxClientLimiters bounds the clients a ClientRateLimiter tracks,
+//clients beyond it share one bucket until idle clients are dropped
+const maxClientLimiters = 10000
+
+//ErrTooManySessions means a limiter or MaxSessions rejected a new session, the client should retry later
+var ErrTooManySessions = errors.New("too many new sessions")
+
+//RateLimiter is a token bucket allowing rate events per second with bursts of burst events
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+//Allow takes a token, it returns false if there is none left
+func (rl *RateLimiter) Allow() bool {
+	now := time.Now()
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	rl.refill(now)
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+func (rl *RateLimiter) refill(now time.Time) {
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+}
+
+//idle reports whether the bucket is full again, so dropping it changes nothing
+func (rl *RateLimiter) idle(now time.Time) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.refill(now)
+	return rl.tokens >= rl.burst
+}
+
+//ClientRateLimiter gives every client its own RateLimiter, so one noisy client does not use up the others' tokens
+type ClientRateLimiter struct {
+	lock     sync.Mutex
+	rate     float64
+	burst    int
+	clients  map[string]*RateLimiter
+	overflow *RateLimiter
+}
+
+func NewClientRateLimiter(rate float64, burst int) *ClientRateLimiter {
+	return &ClientRateLimiter{rate: rate, burst: burst, clients: make(map[string]*RateLimiter), overflow: NewRateLimiter(rate, burst)}
+}
+
+//Allow takes a token of client, it returns false if there is none left
+func (cl *ClientRateLimiter) Allow(client string) bool {
+	return cl.limiter(client).Allow()
+}
+
+func (cl *ClientRateLimiter) limiter(client string) *RateLimiter {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if rl, exist := cl.clients[client]; exist {
+		return rl
+	}
+	if len(cl.clients) >= maxClientLimiters {
+		now := time.Now()
+		for c, rl := range cl.clients {
+			if rl.idle(now) {
+				delete(cl.clients, c)
+			}
+		}
+		if len(cl.clients) >= maxClientLimiters {
+			return cl.overflow
+		}
+	}
+	rl := NewRateLimiter(cl.rate, cl.burst)
+	cl.clients[client] = rl
+	return rl
+}
+
+//ClientAddr is the key of r in a ClientRateLimiter, the host of r.RemoteAddr
+//behind a reverse proxy set r.RemoteAddr from the forwarded address before the handlers run
+func ClientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//sessionCounter counts the sessions created and not yet expired,
+//revoked sessions and sliding expiry are not tracked, so it may count a session longer than it lives
+type sessionCounter struct {
+	lock     sync.Mutex
+	expireAt []int64
+}
+
+//add counts a session living ttlSec, it returns false if max sessions are counted already, max <= 0 does not limit
+func (sc *sessionCounter) add(max int, ttlSec int64) bool {
+	now := time.Now().Unix()
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	i := 0
+	for ; i < len(sc.expireAt) && sc.expireAt[i] <= now; i++ {
+	}
+	sc.expireAt = sc.expireAt[i:]
+	if max > 0 && len(sc.expireAt) >= max {
+		return false
+	}
+	//expired sessions are dropped from the front, after a change of ttlSec some may be dropped late
+	sc.expireAt = append(sc.expireAt, now+ttlSec)
+	return true
+}
+
+func sendTooManySessions(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, ErrTooManySessions.Error(), http.StatusTooManyRequests)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/http/client"
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+func Test_SessionRateLimit(t *testing.T) {
+	priv, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := New(utils.PrivateKeyToString(priv), nil, WithSessionRateLimit(0.001, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/handshake", hs.ServeHandshake)
+	mux.HandleFunc("/session", hs.ServeSession)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	//handshakes and ecs sessions are limited separately
+	publicKey := client.WithPublicKey(utils.PublicKeyToString(&priv.PublicKey))
+	_, err = client.New("", publicKey, client.WithHandshake(ts.URL+"/handshake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.New("", publicKey, client.WithSession(ts.URL+"/session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []client.Option{client.WithHandshake(ts.URL + "/handshake"), client.WithSession(ts.URL + "/session")} {
+		_, err = client.New("", publicKey, opt)
+		var statusError *ecthttp.StatusError
+		if !errors.As(err, &statusError) || statusError.StatusCode != http.StatusTooManyRequests {
+			t.Fatal("session not limited:", err)
+		}
+	}
+}
+
+func Test_NoisyClient(t *testing.T) {
+	priv, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := New(utils.PrivateKeyToString(priv), nil, WithSessionRateLimit(0.001, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(remoteAddr string) int {
+		r := httptest.NewRequest("POST", "/handshake", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		hs.ServeHandshake(w, r)
+		return w.Code
+	}
+	for i := 0; i < 10; i++ {
+		handshake("10.0.0.1:1000")
+	}
+	if code := handshake("10.0.0.1:2000"); code != http.StatusTooManyRequests {
+		t.Fatal("noisy client not limited:", code)
+	}
+	if code := handshake("10.0.0.2:1000"); code == http.StatusTooManyRequests {
+		t.Fatal("other client limited")
+	}
+}
+
+func Test_MaxSessions(t *testing.T) {
+	priv, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := New(utils.PrivateKeyToString(priv), nil, WithMaxSessions(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/handshake", hs.ServeHandshake)
+	mux.HandleFunc("/session", hs.ServeSession)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	publicKey := client.WithPublicKey(utils.PublicKeyToString(&priv.PublicKey))
+	_, err = client.New("", publicKey, client.WithHandshake(ts.URL+"/handshake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []client.Option{client.WithHandshake(ts.URL + "/handshake"), client.WithSession(ts.URL + "/session")} {
+		_, err = client.New("", publicKey, opt)
+		var statusError *ecthttp.StatusError
+		if !errors.As(err, &statusError) || statusError.StatusCode != http.StatusTooManyRequests {
+			t.Fatal("sessions not bounded:", err)
+		}
+	}
+}
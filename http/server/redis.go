@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const DefaultRedisTimeout = 5 * time.Second
+const DefaultRedisMaxIdle = 8
+
+//the largest value redis stores
+const maxRedisBulkSize = 512 << 20
+
+//ErrRedisReply means the server sent a reply that is not valid redis protocol
+var ErrRedisReply = errors.New("redis: reply format error")
+
+//RedisError is an error reply of the redis server
+type RedisError struct {
+	Message string
+}
+
+func (e *RedisError) Error() string {
+	return "redis: " + e.Message
+}
+
+//RedisKeyStore is a KeyStore and NonceStore in a redis server, or any server speaking the redis protocol,
+//so instances behind a load balancer share keys, sessions and seen nonces
+type RedisKeyStore struct {
+	Addr     string
+	Password string
+	DB       int
+	//prepended to every key, e.g. "ectm:"
+	Prefix string
+	//limits dialing and every command, DefaultRedisTimeout if 0
+	Timeout time.Duration
+
+	idle chan *redisConn
+}
+
+func NewRedisKeyStore(addr string, password string, db int) *RedisKeyStore {
+	return &RedisKeyStore{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+		Timeout:  DefaultRedisTimeout,
+		idle:     make(chan *redisConn, DefaultRedisMaxIdle),
+	}
+}
+
+func (ks *RedisKeyStore) Get(key string) ([]byte, bool, error) {
+	reply, err := ks.do("GET", ks.Prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return value, true, nil
+}
+
+func (ks *RedisKeyStore) Set(key string, value []byte, ttlSec int64) error {
+	if ttlSec <= 0 {
+		return ErrInvalidTTL
+	}
+	_, err := ks.do("SET", ks.Prefix+key, string(value), "EX", strconv.FormatInt(ttlSec, 10))
+	return err
+}
+
+func (ks *RedisKeyStore) Delete(key string) error {
+	_, err := ks.do("DEL", ks.Prefix+key)
+	return err
+}
+
+func (ks *RedisKeyStore) Touch(key string, ttlSec int64) (bool, error) {
+	if ttlSec <= 0 {
+		return false, ErrInvalidTTL
+	}
+	reply, err := ks.do("EXPIRE", ks.Prefix+key, strconv.FormatInt(ttlSec, 10))
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+//Add implements NonceStore with SET NX, so a nonce is accepted by one instance only
+func (ks *RedisKeyStore) Add(key string, ttlSec int64) error {
+	if ttlSec <= 0 {
+		return ErrInvalidTTL
+	}
+	reply, err := ks.do("SET", ks.Prefix+"nonce:"+key, "1", "EX", strconv.FormatInt(ttlSec, 10), "NX")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrReplayedRequest
+	}
+	return nil
+}
+
+//do sends one command on an idle or new connection
+//connections that failed are closed, they may have a reply pending
+func (ks *RedisKeyStore) do(args ...string) (interface{}, error) {
+	conn, err := ks.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ks.timeout(), args...)
+	var redisError *RedisError
+	if err != nil && !errors.As(err, &redisError) {
+		conn.Close()
+		return nil, err
+	}
+	ks.putConn(conn)
+	return reply, err
+}
+
+func (ks *RedisKeyStore) timeout() time.Duration {
+	if ks.Timeout <= 0 {
+		return DefaultRedisTimeout
+	}
+	return ks.Timeout
+}
+
+func (ks *RedisKeyStore) getConn() (*redisConn, error) {
+	select {
+	case conn := <-ks.idle:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", ks.Addr, ks.timeout())
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn)}
+	if ks.Password != "" {
+		_, err = conn.do(ks.timeout(), "AUTH", ks.Password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if ks.DB != 0 {
+		_, err = conn.do(ks.timeout(), "SELECT", strconv.Itoa(ks.DB))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (ks *RedisKeyStore) putConn(conn *redisConn) {
+	select {
+	case ks.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+//Close closes the idle connections
+func (ks *RedisKeyStore) Close() error {
+	for {
+		select {
+		case conn := <-ks.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+//redisConn is a connection speaking RESP, the redis serialization protocol
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+//do writes the command as array of bulk strings and reads the reply
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	err := c.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(c.Conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.r)
+}
+
+//readRedisReply reads one reply, a string, int64, []byte, []interface{} or nil
+//an error reply is returned as *RedisError
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrRedisReply
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, &RedisError{Message: line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		if size > maxRedisBulkSize {
+			return nil, fmt.Errorf("%w: bulk reply too large", ErrRedisReply)
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			replies[i], err = readRedisReply(r)
+			var redisError *RedisError
+			if err != nil && !errors.As(err, &redisError) {
+				return nil, err
+			}
+			if err != nil {
+				replies[i] = err
+			}
+		}
+		return replies, nil
+	default:
+		return nil, ErrRedisReply
+	}
+}
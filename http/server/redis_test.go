@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daqnext/ECTSM-go/http/client"
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//fakeRedis is a stand-in redis server for the commands RedisKeyStore sends
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	lock     sync.Mutex
+	values   map[string]string
+	expireAt map[string]time.Time
+	now      time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{listener: listener, password: password, values: map[string]string{}, expireAt: map[string]time.Time{}, now: time.Now()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) advance(d time.Duration) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	fr.now = fr.now.Add(d)
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := fr.password == ""
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		if strings.ToUpper(args[0]) == "AUTH" {
+			authed = len(args) == 2 && args[1] == fr.password
+			if !authed {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+				continue
+			}
+		}
+		if !authed {
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+		conn.Write([]byte(fr.exec(args)))
+	}
+}
+
+func (fr *fakeRedis) exec(args []string) string {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		if expireAt, ok := fr.expireAt[key]; ok && !fr.now.Before(expireAt) {
+			delete(fr.values, key)
+			delete(fr.expireAt, key)
+		}
+	}
+	_, exist := fr.values[key]
+
+	switch strings.ToUpper(args[0]) {
+	case "AUTH", "SELECT", "PING":
+		return "+OK\r\n"
+	case "GET":
+		if !exist {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(fr.values[key]), fr.values[key])
+	case "SET":
+		var ttl int
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if exist {
+					return "$-1\r\n"
+				}
+			case "EX":
+				i++
+				ttl, _ = strconv.Atoi(args[i])
+			}
+		}
+		fr.values[key] = args[2]
+		delete(fr.expireAt, key)
+		if ttl > 0 {
+			fr.expireAt[key] = fr.now.Add(time.Duration(ttl) * time.Second)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		delete(fr.values, key)
+		delete(fr.expireAt, key)
+		if exist {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "EXPIRE":
+		if !exist {
+			return ":0\r\n"
+		}
+		ttl, _ := strconv.Atoi(args[2])
+		fr.expireAt[key] = fr.now.Add(time.Duration(ttl) * time.Second)
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func Test_RedisKeyStore(t *testing.T) {
+	fr := newFakeRedis(t, "secret")
+	defer fr.listener.Close()
+	ks := NewRedisKeyStore(fr.listener.Addr().String(), "secret", 1)
+	ks.Prefix = "ectm:"
+	defer ks.Close()
+
+	if _, exist, err := ks.Get("a"); exist || err != nil {
+		t.Fatal("missing key found:", err)
+	}
+	value := []byte("binary\r\n\x00value")
+	if err := ks.Set("a", value, 10); err != nil {
+		t.Fatal(err)
+	}
+	got, exist, err := ks.Get("a")
+	if err != nil || !exist || string(got) != string(value) {
+		t.Fatal(err, exist, got)
+	}
+
+	//Touch moves the expiry
+	fr.advance(8 * time.Second)
+	if exist, err := ks.Touch("a", 10); !exist || err != nil {
+		t.Fatal("touch failed:", err)
+	}
+	fr.advance(8 * time.Second)
+	if _, exist, _ := ks.Get("a"); !exist {
+		t.Fatal("touched key expired")
+	}
+	fr.advance(3 * time.Second)
+	if _, exist, _ := ks.Get("a"); exist {
+		t.Fatal("key not expired")
+	}
+	if exist, _ := ks.Touch("a", 10); exist {
+		t.Fatal("expired key touched")
+	}
+
+	ks.Set("b", value, 10)
+	if err := ks.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exist, _ := ks.Get("b"); exist {
+		t.Fatal("deleted key found")
+	}
+
+	//NonceStore
+	if err := ks.Add("n", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Add("n", 10); err != ErrReplayedRequest {
+		t.Fatal("duplicate nonce accepted:", err)
+	}
+
+	//a ttl that is not positive would make redis keep or drop the value
+	if err := ks.Set("c", value, 0); err != ErrInvalidTTL {
+		t.Fatal("zero ttl accepted:", err)
+	}
+	if _, err := ks.Touch("a", -1); err != ErrInvalidTTL {
+		t.Fatal("negative ttl accepted:", err)
+	}
+	if err := ks.Add("m", 0); err != ErrInvalidTTL {
+		t.Fatal("zero ttl accepted:", err)
+	}
+
+	//wrong password
+	bad := NewRedisKeyStore(fr.listener.Addr().String(), "wrong", 0)
+	if _, _, err := bad.Get("a"); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+}
+
+//a session created on one instance is used on another sharing the store
+func Test_SharedKeyStore(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.listener.Close()
+	ks := NewRedisKeyStore(fr.listener.Addr().String(), "", 0)
+	defer ks.Close()
+
+	priv, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []*httptest.Server
+	for i := 0; i < 2; i++ {
+		hs, err := New(utils.PrivateKeyToString(priv), nil, WithKeyStore(ks), WithNonceStore(ks))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/session", hs.ServeSession)
+		mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+			ectRq := hs.Handle(r)
+			if ectRq.Err != nil {
+				statusCode, body := ECTSendBackError(w.Header(), ectRq.Err)
+				w.WriteHeader(statusCode)
+				w.Write(body)
+				return
+			}
+			data, _ := ECTSendBackTo(ectRq, w.Header(), "ok")
+			w.Write(data)
+		})
+		servers = append(servers, httptest.NewServer(mux))
+		defer servers[i].Close()
+	}
+
+	hc, err := client.New("", client.WithPublicKey(utils.PublicKeyToString(&priv.PublicKey)), client.WithSession(servers[0].URL+"/session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := hc.SessionId
+	result := hc.ECTGet(servers[1].URL+"/get", nil)
+	if result.Err != nil || result.ToString() != "ok" {
+		t.Fatal(result.Err, result.ToString())
+	}
+	if hc.SessionId != sessionId {
+		t.Fatal("session was renewed")
+	}
+
+	//the store only holds the encrypted key
+	stored, exist, err := ks.Get(sessionCacheKey(sessionId))
+	if err != nil || !exist {
+		t.Fatal("session not stored:", err)
+	}
+	if bytes.Contains(stored, hc.SymmetricKey) {
+		t.Fatal("symmetric key stored in plaintext")
+	}
+}
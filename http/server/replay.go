@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrReplayedRequest = errors.New("replayed request")
+var ErrNonceStoreFull = errors.New("nonce store full")
+
+//NonceStore remembers the nonces seen in the request time window
+type NonceStore interface {
+	//Add stores key for ttlSec seconds
+	//returns ErrReplayedRequest if key is already stored
+	Add(key string, ttlSec int64) error
+}
+
+type nonceEntry struct {
+	key      string
+	expireAt int64
+}
+
+//MemNonceStore is a bounded in-process NonceStore
+//all entries share the same ttl, so they expire in insertion order
+type MemNonceStore struct {
+	lock       sync.Mutex
+	maxEntries int
+	seen       map[string]int64
+	queue      []nonceEntry
+}
+
+func NewMemNonceStore(maxEntries int) *MemNonceStore {
+	return &MemNonceStore{
+		maxEntries: maxEntries,
+		seen:       make(map[string]int64),
+	}
+}
+
+func (ns *MemNonceStore) Add(key string, ttlSec int64) error {
+	now := time.Now().Unix()
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	ns.purge(now)
+	if expireAt, exist := ns.seen[key]; exist && expireAt > now {
+		return ErrReplayedRequest
+	}
+	//fail closed, dropping live entries would allow replays
+	if len(ns.queue) >= ns.maxEntries {
+		return ErrNonceStoreFull
+	}
+	expireAt := now + ttlSec
+	ns.seen[key] = expireAt
+	ns.queue = append(ns.queue, nonceEntry{key: key, expireAt: expireAt})
+	return nil
+}
+
+func (ns *MemNonceStore) purge(now int64) {
+	i := 0
+	for ; i < len(ns.queue) && ns.queue[i].expireAt <= now; i++ {
+		delete(ns.seen, ns.queue[i].key)
+	}
+	ns.queue = ns.queue[i:]
+}
+
+//replayKey keeps store keys short whatever the key identity is
+func replayKey(keyIdentity string, nonce []byte) string {
+	h := sha256.New()
+	h.Write([]byte(keyIdentity))
+	h.Write(nonce)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,28 @@
+package server
+
+import "testing"
+
+func Test_MemNonceStore(t *testing.T) {
+	ns := NewMemNonceStore(2)
+	if err := ns.Add("a", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Add("a", 60); err != ErrReplayedRequest {
+		t.Fatal("duplicate nonce accepted:", err)
+	}
+	if err := ns.Add("b", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Add("c", 60); err != ErrNonceStoreFull {
+		t.Fatal("store not bounded:", err)
+	}
+
+	//expired entries are dropped
+	ns = NewMemNonceStore(1)
+	if err := ns.Add("a", -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Add("a", 60); err != nil {
+		t.Fatal(err)
+	}
+}
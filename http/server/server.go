@@ -4,9 +4,9 @@ import (
 	"crypto/ecdsa"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	ecthttp "github.com/daqnext/ECTSM-go/http"
 	"github.com/daqnext/ECTSM-go/utils"
@@ -15,110 +15,385 @@ import (
 )
 
 type EctHttpServer struct {
+	//the key given to New, see Keyring for the keys in use after RotateKey
 	PrivateKey *ecdsa.PrivateKey
-	Cache      *go_fast_cache.LocalCache
+	//current and retiring private keys used for decryption
+	Keyring *Keyring
+	//long-term key signing the public key info, the key given to New by default,
+	//it does not change with RotateKey so clients can pin it
+	IdentityKey *ecdsa.PrivateKey
+	//symmetric keys of ecs keys and sessions, a MemKeyStore unless set with WithKeyStore,
+	//which New wraps so the store only holds encrypted values
+	KeyStore KeyStore
+	//Deprecated: the cache of the default MemKeyStore, nil with WithKeyStore, use KeyStore
+	Cache *go_fast_cache.LocalCache
+	//how long the key of an ecs key is kept, so it is not decrypted again
+	KeyCacheTTLSec int64
+	//reject requests from peers still using ProtocolVersionCBC
+	//leave it false during migration so old clients keep working
+	RejectLegacyProtocol bool
+	//records request nonces to reject replays, nil disables replay protection
+	NonceStore NonceStore
+	//also reject ProtocolVersionCBC requests without ectm_sig, ProtocolVersionGCM requests must always be signed
+	//leave it false during migration so old clients, which do not sign, keep working
+	RequireSignature bool
+	//lifetime of sessions created by ServeHandshake and ServeSession
+	SessionTTLSec int64
+	//bound how many handshakes and ecs sessions each client starts by ClientAddr, nil does not limit
+	HandshakeLimiter *ClientRateLimiter
+	SessionLimiter   *ClientRateLimiter
+	//bounds the sessions ServeHandshake and ServeSession keep, anyone can start one,
+	//so without a bound the KeyStore can be filled, 0 does not bound
+	MaxSessions int
+	sessions    *sessionCounter
+	//sessions expire SessionTTLSec after their last use instead of after their creation
+	SlidingSessions bool
+	//answers requests Middleware can not decrypt, PlainErrorHandler if nil
+	ErrorHandler ErrorHandler
+	//request headers only accepted in the encrypted ectm_headers header, see ecthttp.CheckPlainHeaders
+	EncryptedRequestHeaders []string
+	//response headers Middleware sends in the encrypted ectm_headers header
+	EncryptedResponseHeaders []string
+	//Middleware streams responses larger than this to clients accepting streams, 0 never streams
+	StreamThreshold int
 }
 
-func New(privateKeyBase64Str string, llog *locallog.LocalLog) (*EctHttpServer, error) {
-	hs := &EctHttpServer{}
+func New(privateKeyBase64Str string, llog *locallog.LocalLog, opts ...Option) (*EctHttpServer, error) {
+	hs := &EctHttpServer{SessionTTLSec: DefaultSessionTTLSec, KeyCacheTTLSec: DefaultKeyCacheTTLSec, StreamThreshold: ecthttp.DefaultStreamThreshold,
+		HandshakeLimiter: NewClientRateLimiter(DefaultSessionRate, DefaultSessionBurst),
+		SessionLimiter:   NewClientRateLimiter(DefaultSessionRate, DefaultSessionBurst),
+		MaxSessions:      DefaultMaxSessions, sessions: &sessionCounter{}}
+	for _, opt := range opts {
+		opt(hs)
+	}
 
 	privateKey, err := utils.StrBase64ToPrivateKey(privateKeyBase64Str)
 	if err != nil {
 		return nil, err
 	}
 	hs.PrivateKey = privateKey
+	hs.Keyring = NewKeyring(privateKey)
+	if hs.IdentityKey == nil {
+		hs.IdentityKey = privateKey
+	}
 
-	lc := go_fast_cache.New(llog)
-	hs.Cache = lc
+	if hs.SessionTTLSec <= 0 || hs.KeyCacheTTLSec <= 0 {
+		return nil, ErrInvalidTTL
+	}
+	if hs.KeyStore == nil {
+		memKeyStore := NewMemKeyStore(llog)
+		hs.KeyStore, hs.Cache = memKeyStore, memKeyStore.cache
+	} else {
+		hs.KeyStore, err = newSealedKeyStore(hs.KeyStore, hs.IdentityKey)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return hs, nil
 }
 
-func (hs *EctHttpServer) HandlePost(httpRequest *http.Request) *ecthttp.ECTRequest { //(symmetricKey []byte, decryptedBody []byte, token []byte, e error)
+//getSymmetricKey returns the key of the request and the identity it was looked up by
+func (hs *EctHttpServer) getSymmetricKey(httpRequest *http.Request) (symmetricKey []byte, keyIdentity string, e error) {
+	//key from a handshake session
+	session, exist := httpRequest.Header["Ectm_session"]
+	if exist && len(session) > 0 && session[0] != "" {
+		sessionKey := sessionCacheKey(session[0])
+		keyByte, exist, err := hs.KeyStore.Get(sessionKey)
+		if err != nil {
+			return nil, "", err
+		}
+		if !exist {
+			return nil, "", ecthttp.ErrUnknownSession
+		}
+		if hs.SlidingSessions {
+			_, err = hs.KeyStore.Touch(sessionKey, hs.SessionTTLSec)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		return keyByte, sessionKey, nil
+	}
 
 	ecs, exist := httpRequest.Header["Ectm_key"]
 	if !exist || len(ecs) < 1 || ecs[0] == "" {
-		return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: nil, DecryptedBody: nil, Err: errors.New("ecs not exist")}
+		return nil, "", ecthttp.ErrMissingKey
 	}
+	//id of the public key the client encrypted to, old clients do not send it
+	keyId := httpRequest.Header.Get("ectm_kid")
 
-	var symmetricKey []byte
-	//try to get from cache
+	//try to get from cache, a store error only costs a decryption
 	ecsBase64Str := ecs[0]
-	ecsByte, _, exist := hs.Cache.Get(ecsBase64Str)
-	if !exist {
-		ct, err := base64.StdEncoding.DecodeString(ecsBase64Str)
-		if err != nil {
-			return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: nil, DecryptedBody: nil, Err: err}
+	cached, exist, err := hs.KeyStore.Get(ecsBase64Str)
+	var entry ecsCacheEntry
+	if err == nil && exist && json.Unmarshal(cached, &entry) == nil {
+		//the key may have retired since
+		if _, active := hs.Keyring.Get(entry.KeyId); !active {
+			return nil, "", ecthttp.ErrUnknownKey
 		}
-		symmetricKey, err = utils.ECCDecrypt(hs.PrivateKey, ct)
-		if err != nil {
-			return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: nil, DecryptedBody: nil, Err: errors.New("ecs decrypt error")}
+		return entry.SymmetricKey, ecsBase64Str, nil
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(ecsBase64Str)
+	if err != nil {
+		return nil, "", &ecthttp.DecryptError{Stage: ecthttp.DecryptStageKey, Err: err}
+	}
+
+	var keys []*KeyringEntry
+	if keyId != "" {
+		key, active := hs.Keyring.Get(keyId)
+		if !active {
+			return nil, "", ecthttp.ErrUnknownKey
 		}
-		hs.Cache.Set(ecsBase64Str, symmetricKey, 3600)
+		keys = []*KeyringEntry{key}
 	} else {
-		symmetricKey = ecsByte.([]byte)
+		keys = hs.Keyring.Active()
 	}
 
-	//check header
-	token, err := ecthttp.DecryptECTMHeader(httpRequest.Header, symmetricKey)
+	err = ecthttp.ErrUnknownKey
+	for _, key := range keys {
+		symmetricKey, err = utils.ECCDecrypt(key.PrivateKey, ct)
+		if err == nil {
+			keyId = key.KeyId
+			break
+		}
+	}
 	if err != nil {
-		return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+		return nil, "", &ecthttp.DecryptError{Stage: ecthttp.DecryptStageKey, Err: err}
+	}
+	//clients may use 128 or 256 bit keys
+	if !utils.IsValidSymmetricKeyLength(len(symmetricKey)) {
+		return nil, "", ecthttp.ErrInvalidKeyLength
+	}
+	cached, err = json.Marshal(&ecsCacheEntry{SymmetricKey: symmetricKey, KeyId: keyId})
+	if err == nil {
+		hs.KeyStore.Set(ecsBase64Str, cached, hs.KeyCacheTTLSec)
 	}
+	return symmetricKey, ecsBase64Str, nil
+}
+
+//ecsCacheEntry remembers which private key decrypted an ecs key, it is stored as json
+type ecsCacheEntry struct {
+	SymmetricKey []byte
+	KeyId        string
+}
 
-	bodybyte, err := ioutil.ReadAll(httpRequest.Body)
+//RotateKey makes privateKeyBase64Str the current key advertised on the info endpoint
+//clients that encrypted to the previous key keep working for retireAfter
+func (hs *EctHttpServer) RotateKey(privateKeyBase64Str string, retireAfter time.Duration) error {
+	privateKey, err := utils.StrBase64ToPrivateKey(privateKeyBase64Str)
+	if err != nil {
+		return err
+	}
+	hs.Keyring.Rotate(privateKey, retireAfter)
+	return nil
+}
+
+func (hs *EctHttpServer) checkHeader(httpRequest *http.Request, symmetricKey []byte) (*ecthttp.ECTMHeader, error) {
+	ectmHeader, err := ecthttp.ParseECTMHeader(httpRequest.Header, symmetricKey)
 	if err != nil {
-		return &ecthttp.ECTRequest{Rq: httpRequest, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: errors.New("body error")}
+		return nil, err
 	}
+	if hs.RejectLegacyProtocol && ectmHeader.Version == ecthttp.ProtocolVersionCBC {
+		return nil, ecthttp.ErrLegacyProtocol
+	}
+	return ectmHeader, nil
+}
 
-	decryptBody, err := ecthttp.DecryptBody(bodybyte, symmetricKey)
+//checkSignature verifies ectm_sig against the request, body is the body as received
+//only legacy ProtocolVersionCBC requests may come without signature, and only when RequireSignature is false
+func (hs *EctHttpServer) checkSignature(httpRequest *http.Request, symmetricKey []byte, ectmHeader *ecthttp.ECTMHeader, body []byte) ([]byte, error) {
+	sig, err := ecthttp.GetRequestSignature(httpRequest.Header)
 	if err != nil {
-		return &ecthttp.ECTRequest{Rq: httpRequest, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: errors.New("decrypt error")}
+		return nil, err
+	}
+	if sig == nil && ectmHeader.Version == ecthttp.ProtocolVersionCBC && !hs.RequireSignature {
+		return nil, nil
+	}
+	err = ecthttp.VerifyRequestSignature(sig, symmetricKey, httpRequest.Method, httpRequest.URL, ectmHeader, body)
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+func (hs *EctHttpServer) checkReplay(keyIdentity string, ectmHeader *ecthttp.ECTMHeader) error {
+	if hs.NonceStore == nil {
+		return nil
+	}
+	if len(ectmHeader.Nonce) == 0 {
+		return ecthttp.ErrMissingNonce
 	}
+	//the time check accepts AllowRequestTimeGapSec on both sides
+	return hs.NonceStore.Add(replayKey(keyIdentity, ectmHeader.Nonce), 2*ecthttp.AllowRequestTimeGapSec)
+}
 
-	return &ecthttp.ECTRequest{Rq: httpRequest, Token: token, SymmetricKey: symmetricKey, DecryptedBody: decryptBody, Err: nil}
+//Handle checks and decrypts a request of any method, the body is decrypted when present
+func (hs *EctHttpServer) Handle(httpRequest *http.Request) *ecthttp.ECTRequest {
+	return hs.handle(httpRequest, false)
+}
 
+//HandleStream is Handle, but a streamed body is not read, the handler reads it from ectRq.BodyReader
+func (hs *EctHttpServer) HandleStream(httpRequest *http.Request) *ecthttp.ECTRequest {
+	return hs.handle(httpRequest, true)
 }
 
-func (hs *EctHttpServer) HandleGet(httpRequest *http.Request) *ecthttp.ECTRequest { // (symmetricKey []byte, token []byte, e error) {
+func (hs *EctHttpServer) handle(httpRequest *http.Request, keepStream bool) *ecthttp.ECTRequest {
 
-	ecs, exist := httpRequest.Header["Ectm_key"]
-	if !exist || len(ecs) < 1 || ecs[0] == "" {
-		return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: nil, DecryptedBody: nil, Err: errors.New("ecs not exist")}
+	symmetricKey, keyIdentity, err := hs.getSymmetricKey(httpRequest)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: nil, DecryptedBody: nil, Err: err}
 	}
 
-	var symmetricKey []byte
-	//try to get from cache
-	ecsBase64Str := ecs[0]
-	ecsByte, _, exist := hs.Cache.Get(ecsBase64Str)
-	if !exist {
-		ct, err := base64.StdEncoding.DecodeString(ecsBase64Str)
-		if err != nil {
-			return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: nil, DecryptedBody: nil, Err: err}
-		}
-		symmetricKey, err = utils.ECCDecrypt(hs.PrivateKey, ct)
+	//check header
+	ectmHeader, err := hs.checkHeader(httpRequest, symmetricKey)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+	version, token := ectmHeader.Version, ectmHeader.Token
+
+	//the handler and the signature see the plain query
+	err = ecthttp.RestoreEncryptedQuery(httpRequest.Header, httpRequest.URL, symmetricKey, version)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+	err = ecthttp.CheckPlainHeaders(httpRequest.Header, hs.EncryptedRequestHeaders)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+	err = ecthttp.RestoreEncryptedHeaders(httpRequest.Header, symmetricKey, ectmHeader)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+
+	streamId, err := ecthttp.GetStreamId(httpRequest.Header)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+	if streamId != nil {
+		return hs.handleStream(httpRequest, symmetricKey, keyIdentity, ectmHeader, streamId, keepStream)
+	}
+
+	var bodybyte []byte
+	if httpRequest.Body != nil {
+		bodybyte, err = ioutil.ReadAll(httpRequest.Body)
 		if err != nil {
-			return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: nil, DecryptedBody: nil, Err: errors.New("ecs decrypt error")}
+			return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: ecthttp.ErrBody}
 		}
-		hs.Cache.Set(ecsBase64Str, symmetricKey, 3600)
-	} else {
-		symmetricKey = ecsByte.([]byte)
 	}
 
-	//check header
-	token, err := ecthttp.DecryptECTMHeader(httpRequest.Header, symmetricKey)
+	sig, err := hs.checkSignature(httpRequest, symmetricKey, ectmHeader, bodybyte)
 	if err != nil {
-		return &ecthttp.ECTRequest{Rq: httpRequest, Token: nil, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
 	}
 
-	return &ecthttp.ECTRequest{Rq: httpRequest, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: nil}
+	err = hs.checkReplay(keyIdentity, ectmHeader)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+
+	decryptBody, err := ecthttp.DecryptBodyWithVersion(bodybyte, symmetricKey, version)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: &ecthttp.DecryptError{Stage: ecthttp.DecryptStageBody, Err: err}}
+	}
+
+	if version == ecthttp.ProtocolVersionCBC {
+		//so ECTSendBack answers in the version the old client can decrypt
+		legacyKeys.add(symmetricKey)
+	}
+	return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, Nonce: ectmHeader.Nonce, Signature: sig, SymmetricKey: symmetricKey, DecryptedBody: decryptBody,
+		AcceptStream: ecthttp.AcceptsStream(httpRequest.Header), Err: nil}
 
 }
 
+//handleStream checks a request with streamed body, the signature covers the stream id instead of the body
+func (hs *EctHttpServer) handleStream(httpRequest *http.Request, symmetricKey []byte, keyIdentity string, ectmHeader *ecthttp.ECTMHeader, streamId []byte, keepStream bool) *ecthttp.ECTRequest {
+	version, token := ectmHeader.Version, ectmHeader.Token
+	if version == ecthttp.ProtocolVersionCBC {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: ecthttp.ErrUnsupportedVersion}
+	}
+
+	sig, err := hs.checkSignature(httpRequest, symmetricKey, ectmHeader, ecthttp.StreamSignBody(streamId))
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+
+	err = hs.checkReplay(keyIdentity, ectmHeader)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+
+	bodyReader, err := ecthttp.NewDecryptReader(httpRequest.Body, symmetricKey, streamId, nil)
+	if err != nil {
+		return &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, SymmetricKey: symmetricKey, DecryptedBody: nil, Err: err}
+	}
+	ectRq := &ecthttp.ECTRequest{Rq: httpRequest, Version: version, Token: token, Nonce: ectmHeader.Nonce, Signature: sig, SymmetricKey: symmetricKey,
+		AcceptStream: ecthttp.AcceptsStream(httpRequest.Header)}
+	if keepStream {
+		ectRq.BodyReader = bodyReader
+		return ectRq
+	}
+
+	ectRq.DecryptedBody, err = ioutil.ReadAll(bodyReader)
+	if err != nil {
+		ectRq.DecryptedBody, ectRq.Err = nil, err
+	}
+	return ectRq
+}
+
+//HandlePost is Handle
+func (hs *EctHttpServer) HandlePost(httpRequest *http.Request) *ecthttp.ECTRequest { //(symmetricKey []byte, decryptedBody []byte, token []byte, e error)
+	return hs.Handle(httpRequest)
+}
+
+//HandleGet is Handle, a GET request has no body
+func (hs *EctHttpServer) HandleGet(httpRequest *http.Request) *ecthttp.ECTRequest { // (symmetricKey []byte, token []byte, e error) {
+	return hs.Handle(httpRequest)
+}
+
+//ECTSendBack encrypts in the version of the last request with symmetricKey, ProtocolVersionCBC for old clients
+//and ecthttp.ProtocolVersion otherwise
+//Deprecated: the response is not bound to a request, so it may be replayed, and ProtocolVersionGCM clients
+//reject it unless created with client.WithUnboundResponses, use ECTSendBackTo
 func ECTSendBack(header http.Header, symmetricKey []byte, data interface{}) ([]byte, error) {
+	return ectSendBack(header, symmetricKey, &ecthttp.ECTMHeader{Version: legacyVersion(symmetricKey)}, data, nil)
+}
+
+//ECTSendBackTo encrypts the response for ectRq with the same protocol version as the request
+//and binds it to the request nonce and signature
+//the headers named in encryptedHeaders are moved into the encrypted ectm_headers header
+func ECTSendBackTo(ectRq *ecthttp.ECTRequest, header http.Header, data interface{}, encryptedHeaders ...string) ([]byte, error) {
+	return ectSendBack(header, ectRq.SymmetricKey, responseECTMHeader(ectRq), data, encryptedHeaders)
+}
+
+//responseECTMHeader is the header of the response to ectRq, in the request version and bound to the request
+func responseECTMHeader(ectRq *ecthttp.ECTRequest) *ecthttp.ECTMHeader {
+	ectmHeader := &ecthttp.ECTMHeader{Version: ectRq.Version}
+	if len(ectRq.Nonce) != 0 {
+		ectmHeader.Bind = ecthttp.RequestDigest(ectRq.Nonce, ectRq.Signature)
+	}
+	return ectmHeader
+}
 
-	err := ecthttp.EncryptAndSetECTMHeader(header, nil, symmetricKey, nil)
+//setResponseHeader sets the ectm_* headers of a response, an error envelope marked in header is bound to the body
+func setResponseHeader(header http.Header, symmetricKey []byte, ectmHeader *ecthttp.ECTMHeader, encryptedHeaders []string) error {
+	ectmHeader.Envelope = ecthttp.GetErrorCode(header) == ecthttp.ErrorCodeEnvelope
+	err := ecthttp.SetECTMHeader(header, nil, symmetricKey, ectmHeader)
 	if err != nil {
-		return nil, errors.New("encrypt response header error")
+		return &ecthttp.EncryptError{Stage: ecthttp.EncryptStageHeader, Err: err}
+	}
+	err = ecthttp.SetEncryptedHeaders(header, encryptedHeaders, symmetricKey, ectmHeader)
+	if err != nil {
+		return &ecthttp.EncryptError{Stage: ecthttp.DecryptStageHeaders, Err: err}
+	}
+	return nil
+}
+
+func ectSendBack(header http.Header, symmetricKey []byte, ectmHeader *ecthttp.ECTMHeader, data interface{}, encryptedHeaders []string) ([]byte, error) {
+
+	err := setResponseHeader(header, symmetricKey, ectmHeader, encryptedHeaders)
+	if err != nil {
+		return nil, err
 	}
 
 	//body encrypt
@@ -137,13 +412,24 @@ func ECTSendBack(header http.Header, symmetricKey []byte, data interface{}) ([]b
 		default:
 			toEncrypt, err = json.Marshal(data)
 			if err != nil {
-				return nil, errors.New("encrypt response data error")
+				return nil, &ecthttp.EncryptError{Stage: ecthttp.DecryptStageBody, Err: err}
 			}
 		}
-		EncryptedBody, err = ecthttp.EncryptBody(toEncrypt, symmetricKey)
+		EncryptedBody, err = ecthttp.EncryptResponseBody(toEncrypt, symmetricKey, ectmHeader)
 		if err != nil {
-			return nil, errors.New("encrypt response data error")
+			return nil, &ecthttp.EncryptError{Stage: ecthttp.DecryptStageBody, Err: err}
 		}
 	}
 	return EncryptedBody, nil
 }
+
+//ECTSendBackError is for requests that could not be decrypted
+//it returns the status code and plain body to send, and sets the ectm_error code the client reacts on
+func ECTSendBackError(header http.Header, err error) (statusCode int, body []byte) {
+	code := ecthttp.ErrorCode(err)
+	if code == "" {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	header.Set("ectm_error", code)
+	return http.StatusUnauthorized, []byte(err.Error())
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"github.com/daqnext/ECTSM-go/http/client"
+	"github.com/daqnext/ECTSM-go/utils"
+	"github.com/imroc/req"
+)
+
+//newTestPair returns a server and a client using its public key
+func newTestPair(t *testing.T, opts ...client.Option) (*EctHttpServer, *client.EctHttpClient) {
+	priv, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := New(utils.PrivateKeyToString(priv), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]client.Option{client.WithPublicKey(utils.PublicKeyToString(&priv.PublicKey))}, opts...)
+	hc, err := client.New("", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hs, hc
+}
+
+func Test_UnsignedRequest(t *testing.T) {
+	priv, err := utils.GenSecp256k1KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := New(utils.PrivateKeyToString(priv), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symmetricKey := utils.GenSymmetricKey()
+	ecsKey, err := utils.ECCEncrypt(&priv.PublicKey, symmetricKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a request as sent by a client that does not sign
+	unsigned := func(version int) *http.Request {
+		body, err := ecthttp.EncryptBodyWithVersion([]byte("body"), symmetricKey, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/post", bytes.NewReader(body))
+		err = ecthttp.EncryptAndSetECTMHeaderWithVersion(r.Header, ecsKey, symmetricKey, nil, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	ectRq := hs.Handle(unsigned(ecthttp.ProtocolVersionGCM))
+	if ectRq.Err != ecthttp.ErrSignatureNotExist {
+		t.Fatal("unsigned request accepted:", ectRq.Err)
+	}
+
+	//legacy clients do not sign
+	ectRq = hs.Handle(unsigned(ecthttp.ProtocolVersionCBC))
+	if ectRq.Err != nil || ectRq.ToString() != "body" {
+		t.Fatal(ectRq.Err, ectRq.ToString())
+	}
+	hs.RequireSignature = true
+	ectRq = hs.Handle(unsigned(ecthttp.ProtocolVersionCBC))
+	if ectRq.Err != ecthttp.ErrSignatureNotExist {
+		t.Fatal("unsigned legacy request accepted:", ectRq.Err)
+	}
+}
+
+func Test_ResponseBodyBinding(t *testing.T) {
+	hs, hc := newTestPair(t)
+	//answers the second request with a correctly bound header but the body of the first response,
+	//like a man in the middle replaying a captured body
+	var lock sync.Mutex
+	var captured []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ectRq := hs.Handle(r)
+		if ectRq.Err != nil {
+			hs.HandleError(w, ectRq)
+			return
+		}
+		body, err := ECTSendBackTo(ectRq, w.Header(), "response:"+ectRq.GetToken())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if captured != nil {
+			body = captured
+		}
+		captured = body
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	result := hc.ECTGet(ts.URL, []byte("1"))
+	if result.Err != nil || result.ToString() != "response:1" {
+		t.Fatal(result.Err, result.ToString())
+	}
+	result = hc.ECTGet(ts.URL, []byte("2"))
+	if !errors.Is(result.Err, ecthttp.ErrDecrypt) {
+		t.Fatal("swapped body accepted:", result.Err, result.ToString())
+	}
+	rs, err := (&http.Client{Transport: hc.Transport()}).Get(ts.URL)
+	if err == nil {
+		rs.Body.Close()
+		t.Fatal("swapped body accepted by Transport")
+	}
+}
+
+func Test_UnboundResponse(t *testing.T) {
+	hs, hc := newTestPair(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ectRq := hs.Handle(r)
+		if ectRq.Err != nil {
+			hs.HandleError(w, ectRq)
+			return
+		}
+		body, _ := ECTSendBack(w.Header(), ectRq.SymmetricKey, "unbound")
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	result := hc.ECTGet(ts.URL, nil)
+	if result.Err != ecthttp.ErrResponseMismatch {
+		t.Fatal("unbound response accepted:", result.Err)
+	}
+
+	publicKey := client.WithPublicKey(utils.PublicKeyToString(&hs.PrivateKey.PublicKey))
+	lax, err := client.New("", publicKey, client.WithUnboundResponses())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = lax.ECTGet(ts.URL, nil)
+	if result.Err != nil || result.ToString() != "unbound" {
+		t.Fatal(result.Err, result.ToString())
+	}
+
+	//legacy responses are never bound
+	legacy, err := client.New("", publicKey, client.WithProtocolVersion(ecthttp.ProtocolVersionCBC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = legacy.ECTGet(ts.URL, nil)
+	if result.Err != nil || result.ToString() != "unbound" {
+		t.Fatal(result.Err, result.ToString())
+	}
+}
+
+func Test_LegacySendBack(t *testing.T) {
+	hs, hc := newTestPair(t, client.WithUnboundResponses())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ectRq := hs.Handle(r)
+		if ectRq.Err != nil {
+			hs.HandleError(w, ectRq)
+			return
+		}
+		body, _ := ECTSendBack(w.Header(), ectRq.SymmetricKey, "legacy")
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	result := hc.ECTGet(ts.URL, nil)
+	if result.Err != nil || result.ToString() != "legacy" || result.Rs.Header.Get("ectm_version") != "2" {
+		t.Fatal(result.Err, result.ToString())
+	}
+
+	//old clients get an answer they can decrypt
+	legacy, err := client.New("", client.WithPublicKey(utils.PublicKeyToString(&hs.PrivateKey.PublicKey)), client.WithProtocolVersion(ecthttp.ProtocolVersionCBC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = legacy.ECTGet(ts.URL, nil)
+	if result.Err != nil || result.ToString() != "legacy" || result.Rs.Header.Get("ectm_version") != "" {
+		t.Fatal(result.Err, result.ToString())
+	}
+}
+
+//roundTripFunc lets a test change requests on the wire
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func Test_EncryptedRequestHeaders(t *testing.T) {
+	//a man in the middle replacing the encrypted headers with plain ones
+	strip := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("ectm_headers") != "" {
+			r.Header.Del("ectm_headers")
+			r.Header.Set("Authorization", "forged")
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	hs, hc := newTestPair(t, client.WithEncryptedHeaders("Authorization"))
+	ts := httptest.NewServer(hs.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	})))
+	defer ts.Close()
+
+	result := hc.ECTGet(ts.URL, nil, req.Header{"Authorization": "secret"})
+	if result.Err != nil || result.ToString() != "secret" {
+		t.Fatal(result.Err, result.ToString())
+	}
+
+	tampered, err := client.New("", client.WithPublicKey(utils.PublicKeyToString(&hs.PrivateKey.PublicKey)),
+		client.WithEncryptedHeaders("Authorization"), client.WithHTTPTransport(strip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = tampered.ECTGet(ts.URL, nil, req.Header{"Authorization": "secret"})
+	var statusError *ecthttp.StatusError
+	if !errors.As(result.Err, &statusError) || string(statusError.Body) != ecthttp.ErrSignatureMismatch.Error() {
+		t.Fatal("stripped headers accepted:", result.Err, result.ToString())
+	}
+
+	//a client sending the header plain
+	hs.EncryptedRequestHeaders = []string{"Authorization"}
+	plain, err := client.New("", client.WithPublicKey(utils.PublicKeyToString(&hs.PrivateKey.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = plain.ECTGet(ts.URL, nil, req.Header{"Authorization": "secret"})
+	if !errors.As(result.Err, &statusError) || !bytes.HasPrefix(statusError.Body, []byte(ecthttp.ErrPlainHeader.Error())) {
+		t.Fatal("plain header accepted:", result.Err, result.ToString())
+	}
+}
+
+func Test_SymmetricKeyLength(t *testing.T) {
+	hs, hc := newTestPair(t, client.WithSymmetricKeyLength(utils.SymmetricKeyLen128))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ectRq := hs.Handle(r)
+		if ectRq.Err != nil {
+			hs.HandleError(w, ectRq)
+			return
+		}
+		body, _ := ECTSendBackTo(ectRq, w.Header(), strconv.Itoa(len(ectRq.SymmetricKey))+":"+ectRq.ToString())
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	result := hc.ECTPost(ts.URL, nil, "body")
+	if result.Err != nil || result.ToString() != "16:body" {
+		t.Fatal(result.Err, result.ToString())
+	}
+
+	//keys of other lengths are rejected
+	symmetricKey := make([]byte, 24)
+	ecsKey, err := utils.ECCEncrypt(&hs.PrivateKey.PublicKey, symmetricKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/post", nil)
+	r.Header.Set("ectm_key", base64.StdEncoding.EncodeToString(ecsKey))
+	ectRq := hs.Handle(r)
+	if ectRq.Err != ecthttp.ErrInvalidKeyLength {
+		t.Fatal("invalid key length accepted:", ectRq.Err)
+	}
+}
+
+func Test_ErrorEnvelope(t *testing.T) {
+	hs, hc := newTestPair(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ectRq := hs.Handle(r)
+		if ectRq.Err != nil {
+			hs.HandleError(w, ectRq)
+			return
+		}
+		body, err := ECTSendBackErrorTo(ectRq, w.Header(), &ecthttp.ErrorEnvelope{Code: "not_found", Message: "no such user", Details: map[string]string{"user": "alice"}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	result := hc.ECTGet(ts.URL, nil, req.Header{"X-Request-Id": "request-1"})
+	var remoteError *ecthttp.RemoteError
+	if !errors.As(result.Err, &remoteError) {
+		t.Fatal("not an envelope:", result.Err)
+	}
+	if remoteError.StatusCode != http.StatusNotFound || remoteError.Code != "not_found" || remoteError.Message != "no such user" ||
+		remoteError.Version != ecthttp.ErrorEnvelopeVersion || remoteError.RequestId != "request-1" || string(remoteError.Details) != `{"user":"alice"}` {
+		t.Fatal(remoteError, string(remoteError.Details))
+	}
+}
+
+func Test_EncryptError(t *testing.T) {
+	ectRq := &ecthttp.ECTRequest{Version: 99, SymmetricKey: utils.GenSymmetricKey()}
+	_, err := ECTSendBackTo(ectRq, make(http.Header), "data")
+	var encryptErr *ecthttp.EncryptError
+	if !errors.Is(err, ecthttp.ErrEncrypt) || !errors.As(err, &encryptErr) ||
+		encryptErr.Stage != ecthttp.EncryptStageHeader || !errors.Is(err, ecthttp.ErrUnsupportedVersion) {
+		t.Fatal("expected encrypt error:", err)
+	}
+}
+
+func Test_DefaultKeyStore(t *testing.T) {
+	hs, _ := newTestPair(t)
+	//the deprecated Cache is the cache of the default store
+	err := hs.KeyStore.Set(sessionCacheKey("id"), []byte("key"), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, exist := hs.Cache.Get(sessionCacheKey("id")); !exist {
+		t.Fatal("Cache is not the default key store")
+	}
+	if err = hs.DeleteSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exist, _ := hs.KeyStore.Get(sessionCacheKey("id")); exist {
+		t.Fatal("session not deleted")
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+const DefaultSessionTTLSec = 3600
+
+const sessionIdSize = 16
+
+func sessionCacheKey(sessionId string) string {
+	return "session:" + sessionId
+}
+
+func newSessionId() (string, error) {
+	sessionIdByte := make([]byte, sessionIdSize)
+	if _, err := io.ReadFull(rand.Reader, sessionIdByte); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sessionIdByte), nil
+}
+
+//ServeSession is the session endpoint, mount it for POST
+//the client sends its ectm_key once and gets a short session id to send instead in later requests
+func (hs *EctHttpServer) ServeSession(w http.ResponseWriter, r *http.Request) {
+	var ectRq *ecthttp.ECTRequest
+	ecs, exist := r.Header["Ectm_key"]
+	if !exist || len(ecs) < 1 || ecs[0] == "" {
+		ectRq = &ecthttp.ECTRequest{Rq: r, Err: ecthttp.ErrMissingKey}
+	} else {
+		//a session must be established from the ecs key, not from another session
+		r.Header.Del("ectm_session")
+		ectRq = hs.Handle(r)
+	}
+	if ectRq.Err != nil {
+		statusCode, body := ECTSendBackError(w.Header(), ectRq.Err)
+		w.WriteHeader(statusCode)
+		w.Write(body)
+		return
+	}
+
+	//anyone can encrypt an ecs key to the public key
+	if (hs.SessionLimiter != nil && !hs.SessionLimiter.Allow(ClientAddr(r))) || !hs.sessions.add(hs.MaxSessions, hs.SessionTTLSec) {
+		sendTooManySessions(w)
+		return
+	}
+
+	sessionId, err := newSessionId()
+	if err != nil {
+		http.Error(w, "session error", http.StatusInternalServerError)
+		return
+	}
+	err = hs.KeyStore.Set(sessionCacheKey(sessionId), ectRq.SymmetricKey, hs.SessionTTLSec)
+	if err != nil {
+		http.Error(w, "session error", http.StatusInternalServerError)
+		return
+	}
+
+	sendData, err := ECTSendBackTo(ectRq, w.Header(), &ecthttp.SessionResponse{SessionId: sessionId, ExpireSec: hs.SessionTTLSec})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(sendData)
+}
+
+//RevokeSession drops a session, the next request with its id fails with ecthttp.ErrUnknownSession
+//use DeleteSession to learn if the KeyStore failed
+func (hs *EctHttpServer) RevokeSession(sessionId string) {
+	hs.DeleteSession(sessionId)
+}
+
+//DeleteSession is RevokeSession returning the error of the KeyStore
+func (hs *EctHttpServer) DeleteSession(sessionId string) error {
+	return hs.KeyStore.Delete(sessionCacheKey(sessionId))
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+)
+
+//ErrFlushNotSupported means the ResponseWriter given to NewSSEWriter is not an http.Flusher
+var ErrFlushNotSupported = errors.New("response writer does not support flush")
+
+//ErrEventName means an event name contains a newline
+var ErrEventName = errors.New("event name contains newline")
+
+//SSEWriter sends server-sent events with encrypted data to the client of one request
+//events are numbered from LastEventId+1, the client reads them with EctHttpClient.Subscribe
+type SSEWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	cipher  *ecthttp.EventCipher
+	lock    sync.Mutex
+	seq     uint64
+}
+
+//LastEventId returns the Last-Event-ID a reconnecting client sent, 0 for a new subscription
+//a handler keeping a history should send the events after it first
+func LastEventId(r *http.Request) uint64 {
+	lastEventId, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return lastEventId
+}
+
+//NewSSEWriter sends the header of an encrypted event stream answering ectRq
+//w must support http.Flusher, a ResponseWriter of Middleware is bypassed
+func NewSSEWriter(w http.ResponseWriter, ectRq *ecthttp.ECTRequest) (*SSEWriter, error) {
+	if ectRq.Version == ecthttp.ProtocolVersionCBC {
+		return nil, ecthttp.ErrUnsupportedVersion
+	}
+	if rw, ok := w.(*ResponseWriter); ok {
+		w = rw.detach()
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, ErrFlushNotSupported
+	}
+
+	streamId, err := ecthttp.NewStreamId()
+	if err != nil {
+		return nil, err
+	}
+	header := w.Header()
+	header.Del("Content-Length")
+	ectmHeader := responseECTMHeader(ectRq)
+	err = setResponseHeader(header, ectRq.SymmetricKey, ectmHeader, nil)
+	if err != nil {
+		return nil, err
+	}
+	ecthttp.SetEventStreamHeader(header, streamId)
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+
+	//the events are bound to the request like the response header
+	cipher, err := ecthttp.NewEventCipher(ectRq.SymmetricKey, streamId, ectmHeader.Bind)
+	if err != nil {
+		return nil, err
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	seq := uint64(0)
+	if ectRq.Rq != nil {
+		seq = LastEventId(ectRq.Rq)
+	}
+	return &SSEWriter{w: w, flusher: flusher, cipher: cipher, seq: seq}, nil
+}
+
+//Seq returns the sequence number of the last event sent
+func (sw *SSEWriter) Seq() uint64 {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	return sw.seq
+}
+
+//Send encrypts and sends one event, data is a string, []byte or a value sent as json
+//event is the event name, "" for the default "message"
+func (sw *SSEWriter) Send(event string, data interface{}) error {
+	if strings.ContainsAny(event, "\r\n") {
+		return ErrEventName
+	}
+	var toEncrypt []byte
+	var err error
+	switch data.(type) {
+	case string:
+		toEncrypt = []byte(data.(string))
+	case []byte:
+		toEncrypt = data.([]byte)
+	default:
+		toEncrypt, err = json.Marshal(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	sw.seq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "id: %d\n", sw.seq)
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	fmt.Fprintf(&b, "data: %s\n\n", sw.cipher.Seal(sw.seq, event, toEncrypt))
+	_, err = sw.w.Write([]byte(b.String()))
+	if err != nil {
+		return err
+	}
+	sw.flusher.Flush()
+	return nil
+}
+
+//Retry tells the client how long to wait before reconnecting, in milliseconds
+func (sw *SSEWriter) Retry(milliseconds int) error {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	_, err := fmt.Fprintf(sw.w, "retry: %d\n\n", milliseconds)
+	if err != nil {
+		return err
+	}
+	sw.flusher.Flush()
+	return nil
+}
+
+//Ping sends a comment, which keeps idle connections open through proxies
+func (sw *SSEWriter) Ping() error {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	_, err := sw.w.Write([]byte(": ping\n\n"))
+	if err != nil {
+		return err
+	}
+	sw.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"golang.org/x/net/websocket"
+)
+
+//WebSocketHandlerFunc serves one encrypted websocket channel, ectRq is the checked upgrade request
+//the channel is closed with a close message when it returns
+type WebSocketHandlerFunc func(conn *ecthttp.WebSocketConn, ectRq *ecthttp.ECTRequest)
+
+//WebSocketHandler checks the ectm_* headers of the upgrade request like Handle, then serves an encrypted
+//channel to the client of EctHttpClient.DialWebSocket, register it directly, not behind Middleware
+//requests failing the check are answered by hs.ErrorHandler and not upgraded
+func (hs *EctHttpServer) WebSocketHandler(handler WebSocketHandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ectRq := hs.Handle(r)
+		if ectRq.Err == nil && ectRq.Version == ecthttp.ProtocolVersionCBC {
+			ectRq.Err = ecthttp.ErrUnsupportedVersion
+		}
+		if ectRq.Err != nil {
+			hs.HandleError(w, ectRq)
+			return
+		}
+
+		wsServer := websocket.Server{
+			//the upgrade request is signed with the client key, so the origin check is not needed against cross site requests
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				return nil
+			},
+			Handler: func(ws *websocket.Conn) {
+				conn, err := ecthttp.NewServerWebSocketConn(ws, ectRq.SymmetricKey, responseECTMHeader(ectRq).Bind)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				handler(conn, ectRq)
+			},
+		}
+		wsServer.ServeHTTP(w, r)
+	})
+}
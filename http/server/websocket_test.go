@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ecthttp "github.com/daqnext/ECTSM-go/http"
+	"golang.org/x/net/websocket"
+)
+
+func Test_WebSocketEcho(t *testing.T) {
+	hs, hc := newTestPair(t)
+	ts := httptest.NewServer(hs.WebSocketHandler(func(conn *ecthttp.WebSocketConn, ectRq *ecthttp.ECTRequest) {
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage([]byte(ectRq.GetToken() + ":" + string(message)))
+		}
+	}))
+	defer ts.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http") + "/echo"
+	conn, err := hc.DialWebSocket(context.Background(), wsUrl, []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, message := range []string{"hello", "", "world"} {
+		err = conn.WriteMessage([]byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo, err := conn.ReadMessage()
+		if err != nil || string(echo) != "token:"+message {
+			t.Fatal(err, string(echo))
+		}
+	}
+
+	//an upgrade request without ectm headers is not upgraded
+	_, err = websocket.Dial(wsUrl, "", ts.URL)
+	if err == nil {
+		t.Fatal("plain upgrade request accepted")
+	}
+}
@@ -0,0 +1,7 @@
+package http
+
+//SessionResponse is the encrypted json answer of the session endpoint
+type SessionResponse struct {
+	SessionId string
+	ExpireSec int64
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+var ErrSignatureNotExist = errors.New("request signature not exist")
+var ErrSignatureMismatch = errors.New("request signature mismatch, method, url, body or encrypted headers were changed")
+var ErrResponseMismatch = errors.New("response does not belong to the request")
+
+const signKeyInfo = "ECTSM hmac-sha256 request"
+
+//canonicalRequest is the string covered by ectm_sig
+//method, path, sorted query, time, nonce and body hash joined by "\n",
+//followed by the hash of the ectm_headers header if the request has one, so it can not be stripped or replaced
+func canonicalRequest(method string, u *url.URL, ectmHeader *ECTMHeader, body []byte) []byte {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	fields := []string{
+		strings.ToUpper(method),
+		path,
+		u.Query().Encode(),
+		strconv.FormatInt(ectmHeader.UnixTime, 10),
+		base64.StdEncoding.EncodeToString(ectmHeader.Nonce),
+		hex.EncodeToString(bodyHash[:]),
+	}
+	if ectmHeader.EncryptedHeaders != "" {
+		headersHash := sha256.Sum256([]byte(ectmHeader.EncryptedHeaders))
+		fields = append(fields, hex.EncodeToString(headersHash[:]))
+	}
+	return []byte(strings.Join(fields, "\n"))
+}
+
+//SignRequest computes the HMAC of the request with a key derived from symmetricKey
+//body is the body as sent on the wire
+func SignRequest(symmetricKey []byte, method string, u *url.URL, ectmHeader *ECTMHeader, body []byte) ([]byte, error) {
+	signKey, err := utils.DeriveKey(symmetricKey, nil, signKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, signKey)
+	mac.Write(canonicalRequest(method, u, ectmHeader, body))
+	return mac.Sum(nil), nil
+}
+
+//SetRequestSignature signs the request and sets the ectm_sig header
+func SetRequestSignature(header http.Header, symmetricKey []byte, method string, u *url.URL, ectmHeader *ECTMHeader, body []byte) ([]byte, error) {
+	sig, err := SignRequest(symmetricKey, method, u, ectmHeader, body)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("ectm_sig", base64.StdEncoding.EncodeToString(sig))
+	return sig, nil
+}
+
+//GetRequestSignature reads the ectm_sig header, nil if not exist
+func GetRequestSignature(header http.Header) ([]byte, error) {
+	sigS, exist := header["Ectm_sig"]
+	if !exist || len(sigS) < 1 || sigS[0] == "" {
+		return nil, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigS[0])
+	if err != nil {
+		return nil, fmt.Errorf("signature base64 format error: %w", ErrSignatureMismatch)
+	}
+	return sig, nil
+}
+
+//VerifyRequestSignature checks sig against the request
+func VerifyRequestSignature(sig []byte, symmetricKey []byte, method string, u *url.URL, ectmHeader *ECTMHeader, body []byte) error {
+	if len(sig) == 0 {
+		return ErrSignatureNotExist
+	}
+	expected, err := SignRequest(symmetricKey, method, u, ectmHeader, body)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, expected) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+//RequestDigest identifies a request by its nonce and signature
+//the server echoes it in the encrypted ectm_bind response header
+func RequestDigest(nonce []byte, sig []byte) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(sig)
+	return h.Sum(nil)
+}
+
+//VerifyResponseBinding checks the ectm_bind value of a response against the request it answers
+func VerifyResponseBinding(responseHeader *ECTMHeader, nonce []byte, sig []byte) error {
+	if len(responseHeader.Bind) == 0 || !hmac.Equal(responseHeader.Bind, RequestDigest(nonce, sig)) {
+		return ErrResponseMismatch
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package http
+
+import (
+	"net/url"
+	"testing"
+)
+
+func Test_RequestSignature(t *testing.T) {
+	key := []byte("1234567890abcdef1234567890abcdef")
+	ectmHeader := &ECTMHeader{UnixTime: 1630000000, Nonce: []byte("0123456789abcdef")}
+	u, _ := url.Parse("http://127.0.0.1:8080/test/post?b=2&a=1")
+	body := []byte("body")
+
+	sig, err := SignRequest(key, "POST", u, ectmHeader, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//query order does not matter
+	reordered, _ := url.Parse("http://127.0.0.1:8080/test/post?a=1&b=2")
+	if err := VerifyRequestSignature(sig, key, "POST", reordered, ectmHeader, body); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, _ := url.Parse("http://127.0.0.1:8080/test/other?a=1&b=2")
+	changedQuery, _ := url.Parse("http://127.0.0.1:8080/test/post?a=1&b=3")
+	cases := []struct {
+		method string
+		u      *url.URL
+		body   []byte
+	}{
+		{"PUT", u, body},
+		{"POST", moved, body},
+		{"POST", changedQuery, body},
+		{"POST", u, []byte("other")},
+	}
+	for _, c := range cases {
+		if err := VerifyRequestSignature(sig, key, c.method, c.u, ectmHeader, c.body); err != ErrSignatureMismatch {
+			t.Fatal("changed request accepted:", c.method, c.u, string(c.body))
+		}
+	}
+
+	//the encrypted headers can not be stripped or replaced
+	withHeaders := *ectmHeader
+	withHeaders.EncryptedHeaders = "headers"
+	sig, err = SignRequest(key, "POST", u, &withHeaders, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyRequestSignature(sig, key, "POST", u, ectmHeader, body); err != ErrSignatureMismatch {
+		t.Fatal("stripped headers accepted")
+	}
+	withHeaders.EncryptedHeaders = "other"
+	if err := VerifyRequestSignature(sig, key, "POST", u, &withHeaders, body); err != ErrSignatureMismatch {
+		t.Fatal("replaced headers accepted")
+	}
+
+	if err := VerifyRequestSignature(nil, key, "POST", u, ectmHeader, body); err != ErrSignatureNotExist {
+		t.Fatal("missing signature accepted")
+	}
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+//an encrypted event stream is a text/event-stream whose event data is base64(AES-256-GCM(data))
+//the event id is the sequence number of the event and the nonce of its encryption,
+//so a dropped, replayed or reordered event fails to decrypt or breaks the sequence
+//the event key is derived from the symmetric key and the ectm_events stream id
+
+const eventKeyInfo = "ECTSM event aes-256-gcm"
+
+//ErrEventSequence means an event was dropped or reordered
+var ErrEventSequence = errors.New("event sequence error")
+
+//Event is a decrypted server-sent event
+type Event struct {
+	//sequence number, the event id sent
+	Id    uint64
+	Event string
+	Data  []byte
+}
+
+func (e *Event) ToString() string {
+	return string(e.Data)
+}
+
+//SetEventStreamHeader sets the plain ectm_events header of an encrypted event stream response
+func SetEventStreamHeader(header http.Header, streamId []byte) {
+	header.Set("ectm_events", base64.StdEncoding.EncodeToString(streamId))
+}
+
+//GetEventStreamId reads the ectm_events header, nil if the response is not an encrypted event stream
+func GetEventStreamId(header http.Header) ([]byte, error) {
+	return getStreamIdHeader(header, "Ectm_events")
+}
+
+//EventCipher encrypts and decrypts the event data of one event stream
+//additionalData and the event name are authenticated with the data
+type EventCipher struct {
+	aead           cipher.AEAD
+	additionalData []byte
+}
+
+//NewEventCipher returns the EventCipher of the stream, both sides must pass the same additionalData
+func NewEventCipher(symmetricKey []byte, streamId []byte, additionalData []byte) (*EventCipher, error) {
+	aead, err := newStreamAEAD(symmetricKey, streamId, eventKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &EventCipher{aead: aead, additionalData: additionalData}, nil
+}
+
+func (ec *EventCipher) eventAdditionalData(event string) []byte {
+	ad := make([]byte, 0, len(ec.additionalData)+len(event))
+	ad = append(ad, ec.additionalData...)
+	return append(ad, event...)
+}
+
+//Seal returns the base64 encrypted data of the event with sequence number seq
+//a sequence number must not be used twice in a stream
+func (ec *EventCipher) Seal(seq uint64, event string, data []byte) string {
+	sealed := ec.aead.Seal(nil, chunkNonce(ec.aead, seq), data, ec.eventAdditionalData(event))
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+//Open decrypts the data of the event with sequence number seq
+func (ec *EventCipher) Open(seq uint64, event string, data string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, &DecryptError{Stage: DecryptStageBody, Err: err}
+	}
+	plain, err := ec.aead.Open(sealed[:0], chunkNonce(ec.aead, seq), sealed, ec.eventAdditionalData(event))
+	if err != nil {
+		return nil, &DecryptError{Stage: DecryptStageBody, Err: err}
+	}
+	return plain, nil
+}
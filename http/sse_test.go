@@ -0,0 +1,36 @@
+package http
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_EventCipher(t *testing.T) {
+	key := []byte("1234567890abcdef1234567890abcdef")
+	streamId, err := NewStreamId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := NewEventCipher(key, streamId, []byte("bind"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := ec.Seal(1, "notice", []byte("hello"))
+	plain, err := ec.Open(1, "notice", sealed)
+	if err != nil || string(plain) != "hello" {
+		t.Fatal(err, string(plain))
+	}
+
+	//another sequence number, event name or binding fails
+	if _, err := ec.Open(2, "notice", sealed); !errors.Is(err, ErrDecrypt) {
+		t.Fatal("event accepted with another sequence number")
+	}
+	if _, err := ec.Open(1, "other", sealed); !errors.Is(err, ErrDecrypt) {
+		t.Fatal("event accepted with another name")
+	}
+	other, _ := NewEventCipher(key, streamId, []byte("other"))
+	if _, err := other.Open(1, "notice", sealed); !errors.Is(err, ErrDecrypt) {
+		t.Fatal("event accepted with another binding")
+	}
+}
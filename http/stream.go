@@ -0,0 +1,319 @@
+package http
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/daqnext/ECTSM-go/utils"
+)
+
+//a streamed body is a sequence of chunks, each chunk is
+//length(4 bytes big endian, the high bit marks the last chunk) | AES-256-GCM(plain chunk)
+//the chunk key is derived from the symmetric key and the stream id, the nonce is the chunk sequence number
+//and the last chunk flag is authenticated, so chunks can not be reordered, dropped or cut off
+
+//StreamChunkSize is the max plain size of one chunk
+const StreamChunkSize = 64 * 1024
+const StreamIdSize = 16
+
+//DefaultStreamThreshold is the body size above which the client and Middleware stream bodies
+const DefaultStreamThreshold = 1 << 20
+
+const streamKeyInfo = "ECTSM stream aes-256-gcm"
+const streamFinalFlag = 1 << 31
+
+//ErrStreamTruncated means a stream ended before its last chunk
+var ErrStreamTruncated = errors.New("encrypted stream truncated")
+
+//ErrStreamClosed means a write to an EncryptWriter after Close
+var ErrStreamClosed = errors.New("write to closed encrypted stream")
+
+func NewStreamId() ([]byte, error) {
+	streamId := make([]byte, StreamIdSize)
+	_, err := io.ReadFull(rand.Reader, streamId)
+	if err != nil {
+		return nil, err
+	}
+	return streamId, nil
+}
+
+//SetStreamHeader sets the plain ectm_stream header, telling the body is streamed
+func SetStreamHeader(header http.Header, streamId []byte) {
+	header.Set("ectm_stream", base64.StdEncoding.EncodeToString(streamId))
+}
+
+//GetStreamId reads the ectm_stream header, nil if the body is not streamed
+func GetStreamId(header http.Header) ([]byte, error) {
+	return getStreamIdHeader(header, "Ectm_stream")
+}
+
+func getStreamIdHeader(header http.Header, canonicalName string) ([]byte, error) {
+	streamS, exist := header[canonicalName]
+	if !exist || len(streamS) < 1 || streamS[0] == "" {
+		return nil, nil
+	}
+	streamId, err := base64.StdEncoding.DecodeString(streamS[0])
+	if err != nil || len(streamId) != StreamIdSize {
+		return nil, &DecryptError{Stage: DecryptStageBody, Err: errors.New("stream id format error")}
+	}
+	return streamId, nil
+}
+
+//SetAcceptStream tells the server the client can read streamed responses
+func SetAcceptStream(header http.Header) {
+	header.Set("ectm_stream_accept", "1")
+}
+
+func AcceptsStream(header http.Header) bool {
+	return header.Get("ectm_stream_accept") == "1"
+}
+
+//StreamSignBody is signed instead of the body of a streamed request, the chunks are bound to the stream id
+func StreamSignBody(streamId []byte) []byte {
+	return []byte("ectm_stream:" + base64.StdEncoding.EncodeToString(streamId))
+}
+
+//newStreamAEAD returns the cipher of one stream, info separates the keys of body and event streams
+func newStreamAEAD(symmetricKey []byte, streamId []byte, info string) (cipher.AEAD, error) {
+	key, err := utils.DeriveKey(symmetricKey, streamId, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func chunkAdditionalData(final bool, additionalData []byte) []byte {
+	ad := make([]byte, 1, 1+len(additionalData))
+	if final {
+		ad[0] = 1
+	}
+	return append(ad, additionalData...)
+}
+
+//chunkSealer encrypts the chunks of one stream
+type chunkSealer struct {
+	aead           cipher.AEAD
+	additionalData []byte
+	seq            uint64
+}
+
+func newChunkSealer(symmetricKey []byte, streamId []byte, additionalData []byte) (*chunkSealer, error) {
+	aead, err := newStreamAEAD(symmetricKey, streamId, streamKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkSealer{aead: aead, additionalData: additionalData}, nil
+}
+
+//seal appends the encrypted chunk with its length prefix to dst
+func (cs *chunkSealer) seal(dst []byte, plain []byte, final bool) []byte {
+	sealed := cs.aead.Seal(nil, chunkNonce(cs.aead, cs.seq), plain, chunkAdditionalData(final, cs.additionalData))
+	cs.seq++
+	length := uint32(len(sealed))
+	if final {
+		length |= streamFinalFlag
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], length)
+	dst = append(dst, prefix[:]...)
+	return append(dst, sealed...)
+}
+
+//EncryptWriter writes the encrypted stream of what is written to it
+//Close must be called to write the last chunk, it does not close the underlying writer
+type EncryptWriter struct {
+	w      io.Writer
+	sealer *chunkSealer
+	buf    []byte
+	closed bool
+}
+
+//NewEncryptWriter returns an EncryptWriter to w, additionalData is authenticated with every chunk,
+//the reader must pass the same
+func NewEncryptWriter(w io.Writer, symmetricKey []byte, streamId []byte, additionalData []byte) (*EncryptWriter, error) {
+	sealer, err := newChunkSealer(symmetricKey, streamId, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{w: w, sealer: sealer}, nil
+}
+
+func (ew *EncryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, ErrStreamClosed
+	}
+	n := len(p)
+	for len(p) > 0 {
+		//a full chunk is only written once more data follows, so the last chunk is never empty without need
+		if len(ew.buf) == StreamChunkSize {
+			err := ew.writeChunk(false)
+			if err != nil {
+				return n - len(p), err
+			}
+		}
+		size := StreamChunkSize - len(ew.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		ew.buf = append(ew.buf, p[:size]...)
+		p = p[size:]
+	}
+	return n, nil
+}
+
+//Flush writes the buffered data as a chunk
+func (ew *EncryptWriter) Flush() error {
+	if ew.closed || len(ew.buf) == 0 {
+		return nil
+	}
+	return ew.writeChunk(false)
+}
+
+//Close writes the last chunk
+func (ew *EncryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.writeChunk(true)
+}
+
+func (ew *EncryptWriter) writeChunk(final bool) error {
+	chunk := ew.sealer.seal(nil, ew.buf, final)
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(chunk)
+	return err
+}
+
+//EncryptReader reads the encrypted stream of the data read from r
+type EncryptReader struct {
+	r      *bufio.Reader
+	sealer *chunkSealer
+	plain  []byte
+	out    []byte
+	done   bool
+}
+
+//NewEncryptReader returns an EncryptReader of r, additionalData is authenticated with every chunk
+func NewEncryptReader(r io.Reader, symmetricKey []byte, streamId []byte, additionalData []byte) (*EncryptReader, error) {
+	sealer, err := newChunkSealer(symmetricKey, streamId, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptReader{r: bufio.NewReader(r), sealer: sealer, plain: make([]byte, StreamChunkSize)}, nil
+}
+
+func (er *EncryptReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(er.r, er.plain)
+		final := false
+		switch err {
+		case nil:
+			//the chunk is the last one if nothing follows
+			if _, peekErr := er.r.Peek(1); peekErr == io.EOF {
+				final = true
+			} else if peekErr != nil {
+				return 0, peekErr
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			final = true
+		default:
+			return 0, err
+		}
+		er.out = er.sealer.seal(er.out[:0], er.plain[:n], final)
+		er.done = final
+	}
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+//DecryptReader reads the plain data of an encrypted stream
+//it returns an error instead of io.EOF if the stream was cut off or changed
+type DecryptReader struct {
+	r              io.Reader
+	aead           cipher.AEAD
+	additionalData []byte
+	seq            uint64
+	buf            []byte
+	final          bool
+	err            error
+}
+
+//NewDecryptReader returns a DecryptReader of r, additionalData must be the one the stream was encrypted with
+func NewDecryptReader(r io.Reader, symmetricKey []byte, streamId []byte, additionalData []byte) (*DecryptReader, error) {
+	aead, err := newStreamAEAD(symmetricKey, streamId, streamKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptReader{r: r, aead: aead, additionalData: additionalData}, nil
+}
+
+func (dr *DecryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.final {
+			return 0, io.EOF
+		}
+		dr.err = dr.readChunk()
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+func (dr *DecryptReader) readChunk() error {
+	var prefix [4]byte
+	_, err := io.ReadFull(dr.r, prefix[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrStreamTruncated
+	}
+	if err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	final := length&streamFinalFlag != 0
+	length &^= streamFinalFlag
+	if length < uint32(dr.aead.Overhead()) || length > uint32(StreamChunkSize+dr.aead.Overhead()) {
+		return &DecryptError{Stage: DecryptStageBody, Err: errors.New("stream chunk length error")}
+	}
+
+	sealed := make([]byte, length)
+	_, err = io.ReadFull(dr.r, sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrStreamTruncated
+	}
+	if err != nil {
+		return err
+	}
+	plain, err := dr.aead.Open(sealed[:0], chunkNonce(dr.aead, dr.seq), sealed, chunkAdditionalData(final, dr.additionalData))
+	if err != nil {
+		return &DecryptError{Stage: DecryptStageBody, Err: err}
+	}
+	dr.seq++
+	dr.buf = plain
+	dr.final = final
+	return nil
+}
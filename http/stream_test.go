@@ -0,0 +1,63 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_Stream(t *testing.T) {
+	key := []byte("1234567890abcdef1234567890abcdef")
+	streamId, err := NewStreamId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := []byte("bind")
+
+	for _, size := range []int{0, 1, StreamChunkSize, 3*StreamChunkSize + 7} {
+		data := bytes.Repeat([]byte{'a'}, size)
+
+		var encrypted bytes.Buffer
+		ew, err := NewEncryptWriter(&encrypted, key, streamId, bind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//write in odd pieces
+		for i := 0; i < size; i += 1000 {
+			end := i + 1000
+			if end > size {
+				end = size
+			}
+			ew.Write(data[i:end])
+		}
+		ew.Close()
+
+		//the reader gives the same chunks
+		er, _ := NewEncryptReader(bytes.NewReader(data), key, streamId, bind)
+		pulled, err := ioutil.ReadAll(er)
+		if err != nil || !bytes.Equal(pulled, encrypted.Bytes()) {
+			t.Fatal("encrypt reader and writer differ, size:", size)
+		}
+
+		dr, _ := NewDecryptReader(bytes.NewReader(encrypted.Bytes()), key, streamId, bind)
+		decrypted, err := ioutil.ReadAll(dr)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Fatal("stream round trip failed, size:", size, err)
+		}
+
+		//cut off after the first chunks
+		if size > StreamChunkSize {
+			dr, _ = NewDecryptReader(bytes.NewReader(encrypted.Bytes()[:encrypted.Len()-20]), key, streamId, bind)
+			if _, err := ioutil.ReadAll(dr); !errors.Is(err, ErrStreamTruncated) && !errors.Is(err, ErrDecrypt) {
+				t.Fatal("truncated stream accepted")
+			}
+		}
+
+		//other binding
+		dr, _ = NewDecryptReader(bytes.NewReader(encrypted.Bytes()), key, streamId, []byte("other"))
+		if _, err := ioutil.ReadAll(dr); !errors.Is(err, ErrDecrypt) {
+			t.Fatal("stream accepted with other additional data")
+		}
+	}
+}
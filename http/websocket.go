@@ -0,0 +1,219 @@
+package http
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+//an encrypted websocket channel starts with a hello message from the server:
+//channel id(16 bytes) | AES-256-GCM(empty message, sequence 0)
+//every message is AES-256-GCM encrypted with the key of its direction, derived from the symmetric key and the channel id,
+//the nonce is the message sequence number of that direction and the upgrade request digest is authenticated,
+//so messages can not be dropped, replayed, reordered or moved to another channel
+//the plain message starts with its kind, data or close, a channel ends with a close message,
+//so a connection closed by someone else can not pass for the end of the channel
+
+const webSocketServerKeyInfo = "ECTSM websocket server aes-256-gcm"
+const webSocketClientKeyInfo = "ECTSM websocket client aes-256-gcm"
+
+//kinds of websocket messages, the first byte of the plain message
+const (
+	webSocketMessageData  = 0
+	webSocketMessageClose = 1
+)
+
+//messageCipher numbers and encrypts the messages of one direction
+type messageCipher struct {
+	aead           cipher.AEAD
+	additionalData []byte
+	seq            uint64
+}
+
+func newMessageCipher(symmetricKey []byte, channelId []byte, info string, additionalData []byte) (*messageCipher, error) {
+	aead, err := newStreamAEAD(symmetricKey, channelId, info)
+	if err != nil {
+		return nil, err
+	}
+	return &messageCipher{aead: aead, additionalData: additionalData}, nil
+}
+
+func (mc *messageCipher) seal(dst []byte, plain []byte) []byte {
+	sealed := mc.aead.Seal(dst, chunkNonce(mc.aead, mc.seq), plain, mc.additionalData)
+	mc.seq++
+	return sealed
+}
+
+func (mc *messageCipher) open(sealed []byte) ([]byte, error) {
+	plain, err := mc.aead.Open(nil, chunkNonce(mc.aead, mc.seq), sealed, mc.additionalData)
+	if err != nil {
+		return nil, &DecryptError{Stage: DecryptStageBody, Err: err}
+	}
+	mc.seq++
+	return plain, nil
+}
+
+//WebSocketConn is an encrypted message channel over a websocket connection
+//one goroutine may read while another writes
+type WebSocketConn struct {
+	ws *websocket.Conn
+
+	readLock  sync.Mutex
+	receive   *messageCipher
+	readErr   error
+	writeLock sync.Mutex
+	send      *messageCipher
+	//the close message was sent
+	closed bool
+}
+
+//NewServerWebSocketConn sends the hello message on ws and returns the channel
+//bind is the digest of the upgrade request, see RequestDigest
+func NewServerWebSocketConn(ws *websocket.Conn, symmetricKey []byte, bind []byte) (*WebSocketConn, error) {
+	channelId, err := NewStreamId()
+	if err != nil {
+		return nil, err
+	}
+	send, err := newMessageCipher(symmetricKey, channelId, webSocketServerKeyInfo, bind)
+	if err != nil {
+		return nil, err
+	}
+	receive, err := newMessageCipher(symmetricKey, channelId, webSocketClientKeyInfo, bind)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := send.seal(append([]byte{}, channelId...), nil)
+	err = websocket.Message.Send(ws, hello)
+	if err != nil {
+		return nil, err
+	}
+	return &WebSocketConn{ws: ws, send: send, receive: receive}, nil
+}
+
+//NewClientWebSocketConn reads the hello message from ws and returns the channel
+//it fails if the server does not have the symmetric key or the hello belongs to another upgrade request
+func NewClientWebSocketConn(ws *websocket.Conn, symmetricKey []byte, bind []byte) (*WebSocketConn, error) {
+	var hello []byte
+	err := websocket.Message.Receive(ws, &hello)
+	if err != nil {
+		return nil, err
+	}
+	if len(hello) < StreamIdSize {
+		return nil, &DecryptError{Stage: DecryptStageBody, Err: errors.New("websocket hello format error")}
+	}
+	channelId := hello[:StreamIdSize]
+	receive, err := newMessageCipher(symmetricKey, channelId, webSocketServerKeyInfo, bind)
+	if err != nil {
+		return nil, err
+	}
+	send, err := newMessageCipher(symmetricKey, channelId, webSocketClientKeyInfo, bind)
+	if err != nil {
+		return nil, err
+	}
+	_, err = receive.open(hello[StreamIdSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &WebSocketConn{ws: ws, send: send, receive: receive}, nil
+}
+
+//ErrWebSocketClosed means a write after Close
+var ErrWebSocketClosed = errors.New("websocket channel closed")
+
+//WriteMessage encrypts and sends one message
+func (c *WebSocketConn) WriteMessage(data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closed {
+		return ErrWebSocketClosed
+	}
+	plain := make([]byte, 0, 1+len(data))
+	plain = append(append(plain, webSocketMessageData), data...)
+	return websocket.Message.Send(c.ws, c.send.seal(nil, plain))
+}
+
+//ReadMessage receives and decrypts one message
+//it returns io.EOF once the peer closed the channel, and io.ErrUnexpectedEOF if the connection closed without the close message
+//once a message fails to decrypt every later read fails, the channel is out of sequence
+func (c *WebSocketConn) ReadMessage() ([]byte, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if c.readErr != nil {
+		return nil, c.readErr
+	}
+	var sealed []byte
+	err := websocket.Message.Receive(c.ws, &sealed)
+	if err == io.EOF {
+		c.readErr = io.ErrUnexpectedEOF
+		return nil, c.readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := c.receive.open(sealed)
+	if err == nil && len(plain) == 0 {
+		err = &DecryptError{Stage: DecryptStageBody, Err: errors.New("websocket message format error")}
+	}
+	if err != nil {
+		c.readErr = err
+		return nil, err
+	}
+	switch plain[0] {
+	case webSocketMessageData:
+		return plain[1:], nil
+	case webSocketMessageClose:
+		c.readErr = io.EOF
+		return nil, io.EOF
+	default:
+		c.readErr = &DecryptError{Stage: DecryptStageBody, Err: errors.New("websocket message kind error")}
+		return nil, c.readErr
+	}
+}
+
+//WriteJSON sends v as json message
+func (c *WebSocketConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(data)
+}
+
+//ReadJSON reads a json message into v
+func (c *WebSocketConn) ReadJSON(v interface{}) error {
+	data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	return c.ws.SetDeadline(t)
+}
+
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+//Close sends the close message and closes the websocket connection
+func (c *WebSocketConn) Close() error {
+	c.writeLock.Lock()
+	if !c.closed {
+		c.closed = true
+		//the peer may be gone already, closing the connection is what counts
+		websocket.Message.Send(c.ws, c.send.seal(nil, []byte{webSocketMessageClose}))
+	}
+	c.writeLock.Unlock()
+	return c.ws.Close()
+}
@@ -0,0 +1,56 @@
+package http
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daqnext/ECTSM-go/utils"
+	"golang.org/x/net/websocket"
+)
+
+func Test_WebSocketClose(t *testing.T) {
+	key := utils.GenSymmetricKey()
+	bind := RequestDigest([]byte("nonce"), []byte("sig"))
+	for _, authenticated := range []bool{true, false} {
+		ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+			conn, err := NewServerWebSocketConn(ws, key, bind)
+			if err != nil {
+				return
+			}
+			conn.WriteMessage([]byte("bye"))
+			if authenticated {
+				conn.Close()
+			} else {
+				//like a connection closed by someone else
+				ws.Close()
+			}
+		}))
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := NewClientWebSocketConn(ws, key, bind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := conn.ReadMessage()
+		if err != nil || string(message) != "bye" {
+			t.Fatal(err, string(message))
+		}
+		expected := io.EOF
+		if !authenticated {
+			expected = io.ErrUnexpectedEOF
+		}
+		_, err = conn.ReadMessage()
+		if err != expected {
+			t.Fatal("expected", expected, "got", err)
+		}
+		conn.Close()
+		if conn.WriteMessage([]byte("late")) != ErrWebSocketClosed {
+			t.Fatal("write after close accepted")
+		}
+		ts.Close()
+	}
+}
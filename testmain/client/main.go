@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"github.com/daqnext/ECTSM-go/http/client"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"strings"
 )
 
 func main() {
@@ -40,4 +43,22 @@ func main() {
 			fmt.Println("result:", result.ToJson().GetContentAsString())
 		}
 	}
+
+	//any http.Client
+	{
+		httpClient := &http.Client{Transport: hc.Transport()}
+		req, err := http.NewRequest("POST", "http://127.0.0.1:8080/mw/post", strings.NewReader(`{"Name":"Jack"}`))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("ectm_token", "userToken")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			fmt.Println("result:", string(body))
+		}
+	}
 }
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"errors"
+	"io"
 )
 
 func pkcs7Padding(ciphertext []byte, blockSize int) []byte {
@@ -15,6 +17,9 @@ func pkcs7Padding(ciphertext []byte, blockSize int) []byte {
 
 func pkcs7UnPadding(origData []byte) ([]byte, error) {
 	length := len(origData)
+	if length == 0 {
+		return nil, errors.New("PKCS7UnPadding error")
+	}
 	unpadding := int(origData[length-1])
 	index := length - unpadding
 	if index < 0 || index > length {
@@ -23,6 +28,8 @@ func pkcs7UnPadding(origData []byte) ([]byte, error) {
 	return origData[:index], nil
 }
 
+//AESEncrypt is the legacy CBC mode, it uses the key as IV and has no MAC
+//use AESGCMEncrypt for new code
 func AESEncrypt(origin []byte, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -44,6 +51,9 @@ func AESDecrypt(crypted []byte, key []byte) ([]byte, error) {
 	}
 
 	blockSize := block.BlockSize()
+	if len(crypted) == 0 || len(crypted)%blockSize != 0 {
+		return nil, errors.New("crypted data is not a multiple of the block size")
+	}
 	blockMode := cipher.NewCBCDecrypter(block, key[:blockSize])
 	origData := make([]byte, len(crypted))
 	blockMode.CryptBlocks(origData, crypted)
@@ -53,3 +63,54 @@ func AESDecrypt(crypted []byte, key []byte) ([]byte, error) {
 	}
 	return data, nil
 }
+
+const gcmKeyInfo = "ECTSM aes-256-gcm"
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	//derive a 256 bit key so both 128 and 256 bit symmetric keys give AES-256-GCM
+	gcmKey, err := DeriveKey(key, nil, gcmKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(gcmKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//AESGCMEncrypt encrypts with AES-256-GCM and a random nonce
+//output format: nonce(12 bytes) | ciphertext | tag(16 bytes)
+func AESGCMEncrypt(origin []byte, key []byte) ([]byte, error) {
+	return AESGCMEncryptWithAD(origin, key, nil)
+}
+
+//AESGCMEncryptWithAD is AESGCMEncrypt, additionalData is authenticated but not encrypted,
+//decrypt with AESGCMDecryptWithAD and the same additionalData
+func AESGCMEncryptWithAD(origin []byte, key []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(origin)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, origin, additionalData), nil
+}
+
+func AESGCMDecrypt(crypted []byte, key []byte) ([]byte, error) {
+	return AESGCMDecryptWithAD(crypted, key, nil)
+}
+
+func AESGCMDecryptWithAD(crypted []byte, key []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(crypted) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("crypted data too short")
+	}
+	nonce := crypted[:aead.NonceSize()]
+	return aead.Open(nil, nonce, crypted[aead.NonceSize():], additionalData)
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_AESGCM(t *testing.T) {
+	key := []byte("1234567890abcdef")
+	msg := []byte("hello world")
+
+	c1, err := AESGCMEncrypt(msg, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := AESGCMEncrypt(msg, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(c1, c2) {
+		t.Fatal("same plaintext gives same ciphertext")
+	}
+
+	plain, err := AESGCMDecrypt(c1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, msg) {
+		t.Fatal("decrypted msg mismatch")
+	}
+
+	c1[len(c1)-1] ^= 1
+	if _, err := AESGCMDecrypt(c1, key); err == nil {
+		t.Fatal("tampered ciphertext accepted")
+	}
+}
+
+func Test_AESCBC(t *testing.T) {
+	key := []byte("1234567890abcdef")
+	msg := []byte("hello world")
+
+	crypted, err := AESEncrypt(msg, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := AESDecrypt(crypted, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, msg) {
+		t.Fatal("decrypted msg mismatch")
+	}
+
+	if _, err := AESDecrypt(crypted[:5], key); err == nil {
+		t.Fatal("short ciphertext accepted")
+	}
+}
@@ -1,14 +1,39 @@
 package utils
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"errors"
+	"io"
 )
 
+//supported symmetric key lengths in bytes
+const (
+	SymmetricKeyLen128 = 16
+	SymmetricKeyLen256 = 32
+)
+
+func IsValidSymmetricKeyLength(keyLen int) bool {
+	return keyLen == SymmetricKeyLen128 || keyLen == SymmetricKeyLen256
+}
+
+//GenSymmetricKey generates a 256 bit key from crypto/rand, it panics if crypto/rand fails
+//use GenSymmetricKeyWithLength to get the error instead
 func GenSymmetricKey() []byte {
-	letterRunes := []rune("1234567890abcdefghijklmnopqrstuvwxyz")
-	b := make([]rune, 16)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+	key, err := GenSymmetricKeyWithLength(SymmetricKeyLen256)
+	if err != nil {
+		panic("utils: crypto/rand failed: " + err.Error())
+	}
+	return key
+}
+
+//GenSymmetricKeyWithLength generates a full entropy key of SymmetricKeyLen128 or SymmetricKeyLen256 bytes
+func GenSymmetricKeyWithLength(keyLen int) ([]byte, error) {
+	if !IsValidSymmetricKeyLength(keyLen) {
+		return nil, errors.New("invalid symmetric key length")
+	}
+	b := make([]byte, keyLen)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
 	}
-	return []byte(string(b))
+	return b, nil
 }
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_GenSymmetricKey(t *testing.T) {
+	if len(GenSymmetricKey()) != SymmetricKeyLen256 {
+		t.Fatal("default key length error")
+	}
+	for _, keyLen := range []int{SymmetricKeyLen128, SymmetricKeyLen256} {
+		k1, err := GenSymmetricKeyWithLength(keyLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k2, err := GenSymmetricKeyWithLength(keyLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(k1) != keyLen || len(k2) != keyLen {
+			t.Fatal("key length error", keyLen)
+		}
+		if bytes.Equal(k1, k2) {
+			t.Fatal("same key generated twice")
+		}
+		//the old keys only used 36 printable characters
+		if isAlnum(k1) && isAlnum(k2) {
+			t.Fatal("keys are not full entropy")
+		}
+	}
+	if _, err := GenSymmetricKeyWithLength(24); err == nil {
+		t.Fatal("invalid key length accepted")
+	}
+}
+
+func isAlnum(b []byte) bool {
+	for _, c := range b {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z') {
+			return false
+		}
+	}
+	return true
+}
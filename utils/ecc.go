@@ -4,7 +4,9 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"math/big"
 
@@ -89,3 +91,36 @@ func GenAndPrintEccKeyPair() (privateKeyBase64Str string, publicKeyBase64Str str
 	publicKeyBase64Str = PublicKeyToString(publicKey)
 	return privateKeyBase64Str, publicKeyBase64Str, nil
 }
+
+//ECDHSharedSecret returns the x coordinate of priv*pub, padded to 32 bytes
+func ECDHSharedSecret(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey) ([]byte, error) {
+	if pub == nil || pub.X == nil || pub.Y == nil || !crypto.S256().IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("invalid public key")
+	}
+	x, _ := crypto.S256().ScalarMult(pub.X, pub.Y, math.PaddedBigBytes(priv.D, 32))
+	if x == nil || x.Sign() == 0 {
+		return nil, errors.New("invalid shared secret")
+	}
+	return math.PaddedBigBytes(x, 32), nil
+}
+
+//ECCSign signs the sha256 hash of msg
+func ECCSign(priv *ecdsa.PrivateKey, msg []byte) ([]byte, error) {
+	hash := sha256.Sum256(msg)
+	return crypto.Sign(hash[:], priv)
+}
+
+//ECCVerify checks a signature made by ECCSign
+func ECCVerify(pub *ecdsa.PublicKey, msg []byte, sig []byte) bool {
+	if pub == nil || pub.X == nil || pub.Y == nil || len(sig) < 64 {
+		return false
+	}
+	hash := sha256.Sum256(msg)
+	return crypto.VerifySignature(elliptic.Marshal(crypto.S256(), pub.X, pub.Y), hash[:], sig[:64])
+}
+
+//PublicKeyId is a short id of a public key, the hex of the first 8 bytes of the sha256 of the raw key
+func PublicKeyId(pub *ecdsa.PublicKey) string {
+	sum := sha256.Sum256(elliptic.Marshal(crypto.S256(), pub.X, pub.Y))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_ECDH(t *testing.T) {
+	a, _ := GenSecp256k1KeyPair()
+	b, _ := GenSecp256k1KeyPair()
+
+	s1, err := ECDHSharedSecret(a, &b.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := ECDHSharedSecret(b, &a.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s1, s2) {
+		t.Fatal("shared secret mismatch")
+	}
+
+	invalid, _ := StrBase64ToPublicKey("AAAA")
+	if _, err := ECDHSharedSecret(a, invalid); err == nil {
+		t.Fatal("invalid public key accepted")
+	}
+}
+
+func Test_ECCSign(t *testing.T) {
+	priv, _ := GenSecp256k1KeyPair()
+	other, _ := GenSecp256k1KeyPair()
+	msg := []byte("hello world")
+
+	sig, err := ECCSign(priv, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ECCVerify(&priv.PublicKey, msg, sig) {
+		t.Fatal("signature not verified")
+	}
+	if ECCVerify(&other.PublicKey, msg, sig) {
+		t.Fatal("signature verified with other key")
+	}
+	if ECCVerify(&priv.PublicKey, []byte("hello"), sig) {
+		t.Fatal("signature verified for other msg")
+	}
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+//DeriveKey derives a sub key of length bytes from secret with HKDF-SHA256
+//different info strings give independent keys for different purposes
+func DeriveKey(secret []byte, salt []byte, info string, length int) ([]byte, error) {
+	key := make([]byte, length)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}